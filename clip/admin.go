@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin dashboard at /admin lists every share, with filters, a sort
+// order and bulk actions, along with the storage in use, who is using it,
+// and each share's recent audit records. It sits behind HTTP basic auth as
+// -admin-user, with the password read from CLIP_ADMIN_PASSWORD so it stays
+// out of process listings. Without a password the dashboard doesn't exist.
+
+var (
+	adminUser     = "admin"
+	adminPassword = os.Getenv("CLIP_ADMIN_PASSWORD")
+)
+
+// topUploaderCount is how many owners the dashboard ranks.
+const topUploaderCount = 10
+
+// requireAdmin serves next only to requests carrying the admin credentials.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminPassword == "" {
+			http.NotFound(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok || !adminCredentials(user, password) {
+			if ok {
+				slog.Warn("Failed admin login", "ip", clientIP(r), "user", user)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="clip admin", charset="UTF-8"`)
+			http.Error(w, "Admin login required", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		next(w, r)
+	}
+}
+
+// adminCredentials compares hashes, so the time taken says nothing about
+// either value, not even its length.
+func adminCredentials(user, password string) bool {
+	u1, u2 := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(adminUser))
+	p1, p2 := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(adminPassword))
+	userOK := subtle.ConstantTimeCompare(u1[:], u2[:])
+	passwordOK := subtle.ConstantTimeCompare(p1[:], p2[:])
+	return userOK&passwordOK == 1
+}
+
+// adminQuery is the dashboard's filter and sort order, from its query
+// string. The raw values are kept to fill the filter form back in.
+type adminQuery struct {
+	Kind, Owner, MinSize, MaxSize, MinAge, MaxAge, MinViews string
+	Sort                                                    string
+	Desc                                                    bool
+
+	minSize, maxSize int64
+	minAge, maxAge   time.Duration
+	minViews         int
+}
+
+// adminSorts are the columns the share list can be sorted by, each
+// ascending.
+var adminSorts = map[string]func(a, b Share) bool{
+	"id":      func(a, b Share) bool { return a.ID < b.ID },
+	"kind":    func(a, b Share) bool { return a.Kind < b.Kind },
+	"size":    func(a, b Share) bool { return a.Size < b.Size },
+	"owner":   func(a, b Share) bool { return a.Owner < b.Owner },
+	"views":   func(a, b Share) bool { return a.Views < b.Views },
+	"created": func(a, b Share) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"expires": func(a, b Share) bool { return a.ExpiresAt.Before(b.ExpiresAt) },
+}
+
+// parseAdminQuery reads the filters in q. A value that doesn't parse is
+// reported and otherwise ignored.
+func parseAdminQuery(q url.Values) (adminQuery, error) {
+	aq := adminQuery{
+		Kind:     q.Get("kind"),
+		Owner:    strings.TrimSpace(q.Get("owner")),
+		MinSize:  strings.TrimSpace(q.Get("min_size")),
+		MaxSize:  strings.TrimSpace(q.Get("max_size")),
+		MinAge:   strings.TrimSpace(q.Get("min_age")),
+		MaxAge:   strings.TrimSpace(q.Get("max_age")),
+		MinViews: strings.TrimSpace(q.Get("min_views")),
+		Sort:     q.Get("sort"),
+		Desc:     q.Get("order") == "desc",
+	}
+	if adminSorts[aq.Sort] == nil {
+		// Newest first
+		aq.Sort, aq.Desc = "created", true
+	}
+
+	var errs []string
+	if aq.MinSize != "" {
+		n, err := parseBytes(aq.MinSize)
+		if err != nil {
+			errs = append(errs, "minimum size: "+err.Error())
+		}
+		aq.minSize = n
+	}
+	if aq.MaxSize != "" {
+		n, err := parseBytes(aq.MaxSize)
+		if err != nil {
+			errs = append(errs, "maximum size: "+err.Error())
+		}
+		aq.maxSize = n
+	}
+	if aq.MinAge != "" {
+		d, err := time.ParseDuration(aq.MinAge)
+		if err != nil {
+			errs = append(errs, "minimum age: "+err.Error())
+		}
+		aq.minAge = d
+	}
+	if aq.MaxAge != "" {
+		d, err := time.ParseDuration(aq.MaxAge)
+		if err != nil {
+			errs = append(errs, "maximum age: "+err.Error())
+		}
+		aq.maxAge = d
+	}
+	if aq.MinViews != "" {
+		n, err := strconv.Atoi(aq.MinViews)
+		if err != nil {
+			errs = append(errs, "minimum views: "+err.Error())
+		}
+		aq.minViews = n
+	}
+	if errs != nil {
+		return aq, fmt.Errorf("ignoring %s", strings.Join(errs, "; "))
+	}
+	return aq, nil
+}
+
+func (aq adminQuery) match(s Share, now time.Time) bool {
+	age := now.Sub(s.CreatedAt)
+	return (aq.Kind == "" || string(s.Kind) == aq.Kind) &&
+		(aq.Owner == "" || s.Owner == aq.Owner) &&
+		s.Size >= aq.minSize && (aq.maxSize == 0 || s.Size <= aq.maxSize) &&
+		age >= aq.minAge && (aq.maxAge == 0 || age <= aq.maxAge) &&
+		s.Views >= aq.minViews
+}
+
+// values encodes the query back into URL parameters.
+func (aq adminQuery) values() url.Values {
+	v := url.Values{}
+	for name, value := range map[string]string{
+		"kind": aq.Kind, "owner": aq.Owner,
+		"min_size": aq.MinSize, "max_size": aq.MaxSize,
+		"min_age": aq.MinAge, "max_age": aq.MaxAge,
+		"min_views": aq.MinViews, "sort": aq.Sort,
+	} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	if aq.Desc {
+		v.Set("order", "desc")
+	}
+	return v
+}
+
+// Encode is the query as URL parameters, for a form to come back to.
+func (aq adminQuery) Encode() string {
+	return aq.values().Encode()
+}
+
+// SortURL links to the list sorted by column, reversing the order if it
+// already is.
+func (aq adminQuery) SortURL(column string) string {
+	v := aq.values()
+	v.Set("sort", column)
+	v.Del("order")
+	if column == aq.Sort && !aq.Desc {
+		v.Set("order", "desc")
+	}
+	return "/admin?" + v.Encode()
+}
+
+// SortMark shows which way the list is sorted in column's heading.
+func (aq adminQuery) SortMark(column string) string {
+	switch {
+	case column != aq.Sort:
+		return ""
+	case aq.Desc:
+		return "▼"
+	}
+	return "▲"
+}
+
+// OwnerURL filters the list to one owner's shares.
+func (aq adminQuery) OwnerURL(owner string) string {
+	v := aq.values()
+	v.Set("owner", owner)
+	return "/admin?" + v.Encode()
+}
+
+type adminRow struct {
+	Share
+	SizeLabel string
+	Age       string
+	TimeLeft  string
+	URL       string
+}
+
+func newAdminRow(s Share, now time.Time) adminRow {
+	return adminRow{
+		Share:     s,
+		SizeLabel: formatBytes(s.Size),
+		Age:       formatDuration(now.Sub(s.CreatedAt)),
+		TimeLeft:  formatDuration(s.ExpiresAt.Sub(now)),
+		URL:       "/" + s.Kind.urlType() + "/" + s.ID,
+	}
+}
+
+// adminUsage tallies shares, by kind or by owner.
+type adminUsage struct {
+	Name      string
+	Count     int
+	Size      int64
+	SizeLabel string
+}
+
+type adminPageData struct {
+	Query     adminQuery
+	Rows      []adminRow
+	Total     int
+	Kinds     []adminUsage
+	Uploaders []adminUsage
+	Storage   storageStatus
+	UsedLabel string
+	MaxLabel  string
+	FreeLabel string
+	MetaLabel string
+	Message   string
+	CSRFToken string
+}
+
+// adminHandler shows the dashboard, and on POST applies a bulk action to
+// the shares ticked in it.
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		adminActionHandler(w, r)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseAdminQuery(r.URL.Query())
+	data := adminPageData{Query: query, CSRFToken: csrfToken(w, r)}
+	if err != nil {
+		data.Message = err.Error()
+	}
+
+	now := time.Now()
+	byKind := make(map[ShareKind]*adminUsage)
+	for _, kind := range []ShareKind{KindText, KindFile, KindBundle} {
+		byKind[kind] = &adminUsage{Name: string(kind)}
+	}
+	byOwner := make(map[string]*adminUsage)
+	entriesMu.Lock()
+	all := byCreation(shares)
+	entriesMu.Unlock()
+	for _, s := range all {
+		if byOwner[s.Owner] == nil {
+			byOwner[s.Owner] = &adminUsage{Name: s.Owner}
+		}
+		for _, u := range []*adminUsage{byKind[s.Kind], byOwner[s.Owner]} {
+			if u != nil {
+				u.Count++
+				u.Size += s.Size
+			}
+		}
+		if query.match(s, now) {
+			data.Rows = append(data.Rows, newAdminRow(s, now))
+		}
+	}
+	data.Total = len(all)
+
+	less := adminSorts[query.Sort]
+	sort.SliceStable(data.Rows, func(i, j int) bool {
+		if query.Desc {
+			return less(data.Rows[j].Share, data.Rows[i].Share)
+		}
+		return less(data.Rows[i].Share, data.Rows[j].Share)
+	})
+
+	for _, kind := range []ShareKind{KindText, KindFile, KindBundle} {
+		u := byKind[kind]
+		u.SizeLabel = formatBytes(u.Size)
+		data.Kinds = append(data.Kinds, *u)
+	}
+	for _, u := range byOwner {
+		u.SizeLabel = formatBytes(u.Size)
+		data.Uploaders = append(data.Uploaders, *u)
+	}
+	sort.Slice(data.Uploaders, func(i, j int) bool {
+		a, b := data.Uploaders[i], data.Uploaders[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Name < b.Name
+	})
+	if len(data.Uploaders) > topUploaderCount {
+		data.Uploaders = data.Uploaders[:topUploaderCount]
+	}
+
+	data.Storage = currentStorageStatus()
+	data.UsedLabel = formatBytes(data.Storage.UsedBytes)
+	if data.Storage.MaxBytes > 0 {
+		data.MaxLabel = formatBytes(data.Storage.MaxBytes)
+	}
+	if data.Storage.FreeBytes > 0 {
+		data.FreeLabel = formatBytes(data.Storage.FreeBytes)
+	}
+	_, metaSize := dirUsage(metaDir)
+	data.MetaLabel = formatBytes(metaSize)
+
+	render(w, "admin.html", data)
+}
+
+// adminActionHandler deletes the ticked shares, or moves their expiry by
+// the chosen amount, then goes back to the list as it was filtered.
+func adminActionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	ids := r.PostForm["id"]
+	if len(ids) == 0 {
+		http.Error(w, "No shares selected", http.StatusBadRequest)
+		return
+	}
+
+	var change time.Duration
+	action := r.PostFormValue("action")
+	switch action {
+	case "delete":
+	case "expiry":
+		var err error
+		if change, err = time.ParseDuration(r.PostFormValue("change")); err != nil || change == 0 {
+			http.Error(w, "Invalid expiry change", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	entriesMu.Lock()
+	for _, id := range ids {
+		s, ok := shares[id]
+		if !ok {
+			continue
+		}
+		if action == "delete" {
+			removeShare(s)
+			sharesDeleted.inc(string(s.Kind))
+			audit(r, "deleted", string(s.Kind), id, "by", "admin")
+			continue
+		}
+		// A share moved into the past is removed by the cleanup routine
+		s.ExpiresAt = s.ExpiresAt.Add(change)
+		putShare(s)
+		audit(r, "expiry changed", string(s.Kind), id, "by", "admin", "change", change.String(), "expires_at", s.ExpiresAt)
+	}
+	entriesMu.Unlock()
+
+	back := "/admin"
+	if q, err := url.ParseQuery(r.PostFormValue("return")); err == nil && len(q) > 0 {
+		back += "?" + q.Encode()
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+type adminAuditData struct {
+	ID      string
+	Share   *adminRow
+	Records []auditRecord
+}
+
+// adminAuditHandler shows the audit records kept for one share, which may
+// since have been deleted.
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/audit/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	data := adminAuditData{ID: id, Records: auditTrails.get(id)}
+
+	entriesMu.Lock()
+	s, ok := shares[id]
+	entriesMu.Unlock()
+	if ok {
+		row := newAdminRow(s, time.Now())
+		data.Share = &row
+	}
+	// Newest first
+	for i, j := 0, len(data.Records)-1; i < j; i, j = i+1, j-1 {
+		data.Records[i], data.Records[j] = data.Records[j], data.Records[i]
+	}
+	render(w, "audit.html", data)
+}
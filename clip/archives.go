@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploaded zip and tar files (plain or gzipped) can be browsed from their
+// /f/{id} page, and single members downloaded or previewed. Members are
+// streamed straight out of the archive; nothing is extracted to disk. The
+// listing is made once per file and kept in memory until the file goes.
+//
+// Zstandard-compressed tarballs can't be browsed, as the standard library
+// has no zstd decoder; they are served as ordinary downloads.
+
+const (
+	// maxArchiveEntries bounds how many entries are listed, and read, from
+	// one archive.
+	maxArchiveEntries = 20000
+	// maxArchiveRatio is how many times larger than its compressed form
+	// data may get. Real files rarely pass 20; zip bombs go far beyond.
+	maxArchiveRatio = 100
+	// Small inputs may compress better than that legitimately.
+	archiveRatioSlack = 1 << 20
+)
+
+var (
+	errArchiveBomb    = errors.New("the archive expands too much to be browsed safely")
+	errArchiveEntries = fmt.Errorf("the archive has more than %d entries", maxArchiveEntries)
+)
+
+type archiveMember struct {
+	Name     string
+	Size     int64
+	Packed   int64 // compressed size, zip only
+	Modified time.Time
+	Refused  bool // would expand beyond maxArchiveRatio
+
+	pos int // index among the archive's entries, files or not
+}
+
+func (m archiveMember) SizeLabel() string {
+	return formatBytes(m.Size)
+}
+
+// Previewable reports whether the member can be shown in the browser.
+func (m archiveMember) Previewable() bool {
+	if _, ok := previewImages[strings.ToLower(path.Ext(m.Name))]; ok {
+		return true
+	}
+	return isTextName(m.Name)
+}
+
+// archiveIndex lists an archive's regular files.
+type archiveIndex struct {
+	Kind    string // "zip", "tar" or "tar.gz"
+	Members []archiveMember
+	Err     error // why the listing stopped short, if it did
+}
+
+var (
+	archiveIndexesMu sync.Mutex
+	archiveIndexes   = make(map[string]*archiveIndex)
+)
+
+// textExtensions are the member names previewed as text.
+var textExtensions = map[string]bool{
+	".txt": true, ".log": true, ".md": true, ".csv": true, ".tsv": true, ".json": true, ".xml": true,
+	".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".conf": true, ".cfg": true, ".env": true,
+	".html": true, ".css": true, ".js": true, ".ts": true, ".go": true, ".py": true, ".rb": true,
+	".rs": true, ".java": true, ".c": true, ".h": true, ".cpp": true, ".sh": true, ".sql": true,
+	".diff": true, ".patch": true, ".out": true, ".err": true,
+}
+
+func isTextName(name string) bool {
+	base := strings.ToLower(path.Base(name))
+	switch base {
+	case "readme", "license", "makefile", "dockerfile":
+		return true
+	}
+	ext := path.Ext(base)
+	// Rotated logs such as app.log.1
+	if _, err := strconv.Atoi(strings.TrimPrefix(ext, ".")); err == nil {
+		ext = path.Ext(strings.TrimSuffix(base, ext))
+	}
+	return textExtensions[ext]
+}
+
+// detectArchive looks at a file's leading bytes to see whether it is an
+// archive that can be browsed, returning its kind or "".
+func detectArchive(filePath string) string {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case isTarHeader(head):
+		return "tar"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		// A gzipped file is only browsable if there's a tar inside
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return ""
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return ""
+		}
+		inner := make([]byte, 512)
+		n, _ := io.ReadFull(gz, inner)
+		if isTarHeader(inner[:n]) {
+			return "tar.gz"
+		}
+	}
+	return ""
+}
+
+func isTarHeader(block []byte) bool {
+	return len(block) >= 262 && bytes.Equal(block[257:262], []byte("ustar"))
+}
+
+// archiveFor returns the listing of a file share's archive, or nil if the
+// file isn't one.
+func archiveFor(id, filePath string) *archiveIndex {
+	archiveIndexesMu.Lock()
+	index, ok := archiveIndexes[id]
+	archiveIndexesMu.Unlock()
+	if ok {
+		return index
+	}
+
+	// Listing a large tarball takes a while, so do it unlocked; at worst
+	// two first views both do the work
+	if kind := detectArchive(filePath); kind != "" {
+		index = &archiveIndex{Kind: kind}
+		if kind == "zip" {
+			index.Members, index.Err = listZip(filePath)
+		} else {
+			index.Members, index.Err = listTar(filePath, kind == "tar.gz")
+		}
+		if index.Err != nil {
+			slog.Warn("Archive listing stopped", "id", id, "err", index.Err)
+		}
+	}
+
+	archiveIndexesMu.Lock()
+	archiveIndexes[id] = index
+	archiveIndexesMu.Unlock()
+	return index
+}
+
+// forgetArchive drops a deleted or expired file's listing.
+func forgetArchive(id string) {
+	archiveIndexesMu.Lock()
+	delete(archiveIndexes, id)
+	archiveIndexesMu.Unlock()
+}
+
+func listZip(filePath string) ([]archiveMember, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// archive/zip loads the whole central directory, so check its size
+	// before letting it
+	count, err := zipEntryCount(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if count > maxArchiveEntries {
+		return nil, errArchiveEntries
+	}
+
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	var members []archiveMember
+	for i, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		members = append(members, archiveMember{
+			Name:     zf.Name,
+			Size:     int64(zf.UncompressedSize64),
+			Packed:   int64(zf.CompressedSize64),
+			Modified: zf.Modified,
+			Refused:  zf.UncompressedSize64 > archiveRatioSlack && zf.UncompressedSize64/maxArchiveRatio > zf.CompressedSize64,
+			pos:      i,
+		})
+	}
+	return members, nil
+}
+
+// zipEntryCount reads the number of entries from a zip's end of central
+// directory record, following it to the zip64 record when there is one.
+func zipEntryCount(f *os.File, size int64) (uint64, error) {
+	const eocdLen, locatorLen = 22, 20
+	// The record sits at the end, after a comment of up to 64KB
+	tail := make([]byte, min(size, eocdLen+locatorLen+0xffff))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return 0, err
+	}
+	i := bytes.LastIndex(tail, []byte("PK\x05\x06"))
+	if i < 0 || len(tail)-i < eocdLen {
+		return 0, zip.ErrFormat
+	}
+	count := uint64(binary.LittleEndian.Uint16(tail[i+10:]))
+	if count != 0xffff || i < locatorLen {
+		return count, nil
+	}
+
+	locator := tail[i-locatorLen : i]
+	if !bytes.HasPrefix(locator, []byte("PK\x06\x07")) {
+		return count, nil
+	}
+	record := make([]byte, 56)
+	if _, err := f.ReadAt(record, int64(binary.LittleEndian.Uint64(locator[8:]))); err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(record, []byte("PK\x06\x06")) {
+		return 0, zip.ErrFormat
+	}
+	return binary.LittleEndian.Uint64(record[32:]), nil
+}
+
+// ratioReader fails once what comes out of a decompressor outgrows what
+// went into it by more than maxArchiveRatio.
+type ratioReader struct {
+	r   io.Reader
+	in  *countingReader
+	out int64
+}
+
+func (g *ratioReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	g.out += int64(n)
+	if g.out > archiveRatioSlack && g.out/maxArchiveRatio > g.in.n {
+		return n, errArchiveBomb
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openTar opens a tarball for reading, decompressing it under the ratio
+// guard if it is gzipped.
+func openTar(filePath string, gzipped bool) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !gzipped {
+		return tar.NewReader(bufio.NewReader(f)), f, nil
+	}
+	in := &countingReader{r: f}
+	gz, err := gzip.NewReader(bufio.NewReader(in))
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return tar.NewReader(&ratioReader{r: gz, in: in}), f, nil
+}
+
+func listTar(filePath string, gzipped bool) ([]archiveMember, error) {
+	tr, closer, err := openTar(filePath, gzipped)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var members []archiveMember
+	for pos := 0; ; pos++ {
+		if pos == maxArchiveEntries {
+			return members, errArchiveEntries
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			// Next reads through the previous member, so that's the one
+			// that blew up
+			if errors.Is(err, errArchiveBomb) && len(members) > 0 {
+				members[len(members)-1].Refused = true
+			}
+			return members, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		members = append(members, archiveMember{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Modified: hdr.ModTime,
+			pos:      pos,
+		})
+	}
+}
+
+// openMember streams one member out of an archive.
+func openMember(filePath string, index *archiveIndex, m archiveMember) (io.ReadCloser, error) {
+	if m.Refused {
+		return nil, errArchiveBomb
+	}
+	if index.Kind == "zip" {
+		zr, err := zip.OpenReader(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if m.pos >= len(zr.File) || zr.File[m.pos].Name != m.Name {
+			zr.Close()
+			return nil, os.ErrNotExist
+		}
+		// archive/zip fails the read if a member outgrows its declared size
+		rc, err := zr.File[m.pos].Open()
+		if err != nil {
+			zr.Close()
+			return nil, err
+		}
+		return readCloser{rc, multiCloser{rc, zr}}, nil
+	}
+
+	tr, closer, err := openTar(filePath, index.Kind == "tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	for pos := 0; ; pos++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			closer.Close()
+			if err == io.EOF {
+				err = os.ErrNotExist
+			}
+			return nil, err
+		}
+		if pos == m.pos {
+			if hdr.Name != m.Name {
+				closer.Close()
+				return nil, os.ErrNotExist
+			}
+			return readCloser{tr, closer}, nil
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var errs []error
+	for _, c := range mc {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// wantsPage reports whether a request for a file comes from a browser that
+// would rather see a page than the bytes.
+func wantsPage(r *http.Request) bool {
+	return r.URL.Query().Get("download") == "" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// archivePage lists an archive's members.
+func archivePage(w http.ResponseWriter, r *http.Request, entry Share, index *archiveIndex, size int64) {
+	countView(entry)
+	var problem string
+	if index.Err != nil {
+		problem = "Only part of this archive can be browsed: "
+		if errors.Is(index.Err, errArchiveBomb) || errors.Is(index.Err, errArchiveEntries) {
+			problem += index.Err.Error() + "."
+		} else {
+			problem += "it looks damaged."
+		}
+	}
+	render(w, "archive.html", struct {
+		ID        string
+		URL       string
+		Filename  string
+		Kind      string
+		SizeLabel string
+		TimeLeft  string
+		CreatedAt time.Time
+		Members   []archiveMember
+		Problem   string
+	}{
+		ID:        entry.ID,
+		URL:       r.Host + r.URL.Path,
+		Filename:  entry.Filename,
+		Kind:      index.Kind,
+		SizeLabel: formatBytes(size),
+		TimeLeft:  formatDuration(time.Until(entry.ExpiresAt)),
+		CreatedAt: entry.CreatedAt,
+		Members:   index.Members,
+		Problem:   problem,
+	})
+}
+
+// archiveMemberHandler serves /f/{id}/x/{n}, one member of an archive, as
+// a download or, with ?view=1, for viewing in the browser.
+func archiveMemberHandler(w http.ResponseWriter, r *http.Request, entry Share, filePath, rest string) {
+	index := archiveFor(entry.ID, filePath)
+	n, err := strconv.Atoi(rest)
+	if index == nil || err != nil || n < 0 || n >= len(index.Members) || strconv.Itoa(n) != rest {
+		http.NotFound(w, r)
+		return
+	}
+	m := index.Members[n]
+
+	src, err := openMember(filePath, index, m)
+	if err != nil {
+		if errors.Is(err, errArchiveBomb) {
+			http.Error(w, "This file expands too much to be extracted safely", http.StatusUnprocessableEntity)
+			return
+		}
+		slog.Warn("Failed to open archive member", "id", entry.ID, "member", m.Name, "err", err)
+		http.Error(w, "Failed to read the file from the archive", http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+
+	h := w.Header()
+	sandboxUserContent(w)
+	disposition := "attachment"
+	if r.URL.Query().Get("view") != "" && m.Previewable() {
+		disposition = "inline"
+		if typ, ok := previewImages[strings.ToLower(path.Ext(m.Name))]; ok {
+			h.Set("Content-Type", typ)
+		} else {
+			h.Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		// Previews aren't counted, as the archive page that shows them
+		// already was, but who read what still goes in the audit log
+		audit(r, "viewed", "file", entry.ID, "filename", entry.Filename, "member", m.Name)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+		countView(entry)
+		audit(r, "downloaded", "file", entry.ID, "filename", entry.Filename, "member", m.Name)
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(m.Name)}))
+	h.Set("Content-Length", strconv.FormatInt(m.Size, 10))
+
+	if _, err := io.Copy(w, src); err != nil {
+		slog.Warn("Failed to stream archive member", "id", entry.ID, "member", m.Name, "err", err)
+	}
+}
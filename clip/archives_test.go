@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type testMember struct {
+	name string
+	data []byte
+}
+
+func writeTestZip(t *testing.T, members ...testMember) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(m.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, buf.Bytes())
+}
+
+func writeTestTar(t *testing.T, gzipped bool, members ...testMember) string {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(m.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return writeTestFile(t, buf.Bytes())
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// getMember requests member n of the archive at filePath as share id.
+func getMember(t *testing.T, id, filePath string, n int, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Cleanup(func() { forgetArchive(id) })
+	entry := Share{ID: id, Kind: KindFile, Filename: "upload"}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/f/"+id+"/x/"+strconv.Itoa(n)+query, nil)
+	archiveMemberHandler(w, r, entry, filePath, strconv.Itoa(n))
+	return w
+}
+
+func TestArchiveMemberNames(t *testing.T) {
+	// Members are only ever streamed, never extracted, so a hostile name
+	// can do no more than name the download, and only its last element
+	// makes it into that
+	members := []testMember{
+		{"../../evil.sh", []byte("rm -rf ~")},
+		{"/etc/passwd", []byte("root:x:0:0")},
+		{"docs/../../../notes.txt", []byte("notes")},
+	}
+	wantNames := []string{"evil.sh", "passwd", "notes.txt"}
+
+	for kind, filePath := range map[string]string{
+		"zip":    writeTestZip(t, members...),
+		"tar":    writeTestTar(t, false, members...),
+		"tar.gz": writeTestTar(t, true, members...),
+	} {
+		t.Run(kind, func(t *testing.T) {
+			id := "names-" + kind
+			index := archiveFor(id, filePath)
+			if index == nil || index.Kind != kind {
+				t.Fatalf("detected as %+v, want %s", index, kind)
+			}
+			if index.Err != nil || len(index.Members) != len(members) {
+				t.Fatalf("listed %d members (%v), want %d", len(index.Members), index.Err, len(members))
+			}
+			for i, m := range members {
+				w := getMember(t, id, filePath, i, "?download=1")
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: status %d", m.name, w.Code)
+				}
+				_, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+				if err != nil || params["filename"] != wantNames[i] {
+					t.Errorf("%s: downloaded as %q (%v), want %q", m.name, params["filename"], err, wantNames[i])
+				}
+				if !bytes.Equal(w.Body.Bytes(), m.data) {
+					t.Errorf("%s: got %q, want %q", m.name, w.Body.Bytes(), m.data)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(filePath), "..", "evil.sh")); !os.IsNotExist(err) {
+				t.Errorf("member was written out: %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveEntryLimit(t *testing.T) {
+	members := make([]testMember, maxArchiveEntries+1)
+	for i := range members {
+		members[i].name = "f" + strconv.Itoa(i)
+	}
+
+	if _, err := listZip(writeTestZip(t, members...)); !errors.Is(err, errArchiveEntries) {
+		t.Errorf("zip: listed with %v, want %v", err, errArchiveEntries)
+	}
+	if _, err := listZip(writeTestZip(t, members[:maxArchiveEntries]...)); err != nil {
+		t.Errorf("zip at the limit: %v", err)
+	}
+
+	// A tarball has no directory, so the entries up to the limit are
+	// still listed
+	listed, err := listTar(writeTestTar(t, false, members...), false)
+	if !errors.Is(err, errArchiveEntries) {
+		t.Errorf("tar: listed with %v, want %v", err, errArchiveEntries)
+	}
+	if len(listed) != maxArchiveEntries {
+		t.Errorf("tar: listed %d members, want %d", len(listed), maxArchiveEntries)
+	}
+}
+
+func TestArchiveBomb(t *testing.T) {
+	// Zeros deflate about a thousandfold, well past maxArchiveRatio
+	bomb := testMember{"zeros.txt", make([]byte, 8*archiveRatioSlack)}
+	// Text compresses, but not that much
+	var words strings.Builder
+	for i := words.Len(); words.Len() < 2*archiveRatioSlack; i++ {
+		words.WriteString(strconv.FormatInt(int64(i)*2654435761%1000003, 36) + " ")
+	}
+	text := testMember{"words.txt", []byte(words.String())}
+	small := testMember{"small.txt", make([]byte, archiveRatioSlack)}
+
+	t.Run("zip", func(t *testing.T) {
+		filePath := writeTestZip(t, text, small, bomb)
+		index := archiveFor("bomb-zip", filePath)
+		if index.Err != nil || len(index.Members) != 3 {
+			t.Fatalf("listed %d members (%v), want 3", len(index.Members), index.Err)
+		}
+		for i, refused := range []bool{false, false, true} {
+			if index.Members[i].Refused != refused {
+				t.Errorf("%s: refused %v, want %v", index.Members[i].Name, index.Members[i].Refused, refused)
+			}
+		}
+		if w := getMember(t, "bomb-zip", filePath, 2, "?download=1"); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("bomb served with status %d", w.Code)
+		}
+		if w := getMember(t, "bomb-zip", filePath, 0, "?download=1"); w.Code != http.StatusOK || w.Body.Len() != len(text.data) {
+			t.Errorf("text served with status %d and %d bytes", w.Code, w.Body.Len())
+		}
+	})
+
+	t.Run("tar.gz", func(t *testing.T) {
+		// The whole stream is decompressed to list it, so the listing stops
+		// at the bomb and blames it
+		listed, err := listTar(writeTestTar(t, true, small, bomb, text), true)
+		if !errors.Is(err, errArchiveBomb) {
+			t.Fatalf("listed with %v, want %v", err, errArchiveBomb)
+		}
+		if len(listed) != 2 || listed[0].Refused || !listed[1].Refused {
+			t.Errorf("listed %+v, want small.txt then a refused zeros.txt", listed)
+		}
+	})
+
+	t.Run("zip with a lying size", func(t *testing.T) {
+		// Claiming a small size in the directory doesn't get more out
+		data, err := os.ReadFile(writeTestZip(t, bomb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := bytes.LastIndex(data, []byte("PK\x01\x02"))
+		copy(data[dir+24:dir+28], []byte{0, 4, 0, 0}) // 1KB uncompressed
+		filePath := writeTestFile(t, data)
+		index := archiveFor("bomb-liar", filePath)
+		if len(index.Members) != 1 || index.Members[0].Size != 1024 {
+			t.Fatalf("listed %+v, want one 1KB member", index.Members)
+		}
+		w := getMember(t, "bomb-liar", filePath, 0, "?download=1")
+		if w.Body.Len() > 1024 {
+			t.Errorf("served %d bytes of a member declared as 1024", w.Body.Len())
+		}
+	})
+}
+
+func TestArchivePreviewIsAudited(t *testing.T) {
+	const id = "preview-audit"
+	filePath := writeTestZip(t, testMember{"README", []byte("hello")})
+	w := getMember(t, id, filePath, 0, "?view=1")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline") {
+		t.Fatalf("status %d, disposition %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	records := auditTrails.get(id)
+	if len(records) != 1 || records[0].Action != "viewed" || !strings.Contains(records[0].Details, "member=README") {
+		t.Errorf("audited %+v, want one view of README", records)
+	}
+}
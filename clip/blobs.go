@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A share's files are stored under its storage key, a random hex string
+// recorded on the share. Keys are spread over two levels of directories by
+// their first four characters, so no directory grows past a few thousand
+// entries even with hundreds of thousands of shares:
+//
+//	file          uploads/ab/cd/abcd…
+//	thumbnail     uploads/ab/cd/abcd….thumb.jpg (or .png)
+//	text          uploads/ab/cd/abcd….v1, .v2, … one per revision
+//	bundle        uploads/ab/cd/abcd…/0, 1, … one per file
+//
+// Every path follows from the key, so nothing is found by scanning.
+
+// newStorageKey returns a fresh random key.
+func newStorageKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// blobName is key's path within uploads/.
+func blobName(key string) string {
+	return filepath.Join(key[:2], key[2:4], key)
+}
+
+func blobPath(key string) string {
+	return filepath.Join("uploads", blobName(key))
+}
+
+// makeBlobDir creates the directory that key's files go in.
+func makeBlobDir(key string) error {
+	return os.MkdirAll(filepath.Dir(blobPath(key)), 0755)
+}
+
+// validKey reports whether key looks like one newStorageKey made, so a
+// damaged record can't point outside uploads/.
+func validKey(key string) bool {
+	if len(key) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil && strings.ToLower(key) == key
+}
+
+// shareBlob is a file a share stores. Name is the file's name within the
+// share, as export writes it: v1, v2, … for text, "file" and "thumb.jpg"
+// (or .png) for a file share, files/0, files/1, … for a bundle.
+type shareBlob struct {
+	Name string
+	Path string
+	Size int64 // -1 if not recorded
+}
+
+// shareBlobs lists every file a share stores.
+func shareBlobs(s Share) []shareBlob {
+	if !validKey(s.Key) {
+		return nil
+	}
+	var blobs []shareBlob
+	switch s.Kind {
+	case KindText:
+		for n := 1; n <= len(s.Revisions); n++ {
+			blobs = append(blobs, shareBlob{"v" + strconv.Itoa(n), revisionPath(s.Key, n), -1})
+		}
+	case KindFile:
+		blobs = append(blobs, shareBlob{"file", blobPath(s.Key), s.Size})
+		if s.Thumbnail != "" {
+			blobs = append(blobs, shareBlob{"thumb" + filepath.Ext(s.Thumbnail), filepath.Join("uploads", s.Thumbnail), -1})
+		}
+	case KindBundle:
+		for n, f := range s.Files {
+			blobs = append(blobs, shareBlob{"files/" + strconv.Itoa(n), bundleFilePath(s.Key, n), f.Size})
+		}
+	}
+	return blobs
+}
+
+// blobPathFor is where the file a share calls name belongs, if the share is
+// stored under key; the inverse of shareBlobs.
+func blobPathFor(key, name string) (string, bool) {
+	switch {
+	case name == "file":
+		return blobPath(key), true
+	case name == "thumb.jpg" || name == "thumb.png":
+		return blobPath(key) + ".thumb" + filepath.Ext(name), true
+	case strings.HasPrefix(name, "v"):
+		if n, err := strconv.Atoi(name[1:]); err == nil && n >= 1 && n <= maxRevisions {
+			return revisionPath(key, n), true
+		}
+	case strings.HasPrefix(name, "files/"):
+		if n, err := strconv.Atoi(name[len("files/"):]); err == nil && n >= 0 && n < maxBundleFiles {
+			return bundleFilePath(key, n), true
+		}
+	}
+	return "", false
+}
+
+// removeKeyFiles deletes whatever is stored under key.
+func removeKeyFiles(key string) {
+	paths, _ := filepath.Glob(blobPath(key) + "*")
+	for _, path := range paths {
+		os.RemoveAll(path)
+	}
+}
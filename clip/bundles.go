@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Bundles group the files from one upload under a single link, /b/{id}.
+// Each bundle's files live in their own directory, blobPath of its storage
+// key (uploads/ab/cd/abcd…), numbered in upload order; the original names
+// are kept on the entry.
+// A folder upload is a bundle whose names are relative paths. The tree only
+// exists in those names, so an uploaded path never reaches the filesystem.
+
+type BundleFile struct {
+	Name string // as uploaded, made unique within the bundle; a "/"-separated path for folders
+	Size int64
+}
+
+const (
+	maxBundleFiles = 10000
+	maxPathDepth   = 32
+	// maxPreviews bounds the files read for previews on one page view
+	maxPreviews = 50
+)
+
+// bundleLabel describes a bundle in lists: the folder's name if it holds a
+// single folder, otherwise how many files it has.
+func bundleLabel(files []BundleFile) string {
+	top, _, nested := strings.Cut(files[0].Name, "/")
+	for _, f := range files[1:] {
+		if dir, _, ok := strings.Cut(f.Name, "/"); !ok || dir != top {
+			nested = false
+		}
+	}
+	if nested {
+		return top + "/"
+	}
+	return fmt.Sprintf("%d files", len(files))
+}
+
+// previewImages are shown inline on the bundle page. Anything else,
+// SVG in particular, is only ever offered as a download.
+var previewImages = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+}
+
+// storedCompressed lists extensions that are already compressed, which the
+// zip download stores as they are instead of deflating again.
+var storedCompressed = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".m4a": true, ".mkv": true, ".webm": true, ".mov": true, ".ogg": true,
+	".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true, ".jar": true, ".apk": true,
+}
+
+// cleanUploadPath turns the name a browser sent for an uploaded file into a
+// relative, "/"-separated path. Empty and "." segments are dropped; ".." is
+// refused rather than resolved, as it can only be an attempt to escape.
+func cleanUploadPath(name string) (string, error) {
+	segments := strings.Split(strings.ReplaceAll(name, `\`, "/"), "/")
+	// A Windows drive letter isn't part of the folder
+	if len(segments) > 1 && len(segments[0]) == 2 && segments[0][1] == ':' {
+		segments = segments[1:]
+	}
+	var clean []string
+	for _, seg := range segments {
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("%s: paths may not leave the uploaded folder", name)
+		}
+		if !utf8.ValidString(seg) || strings.ContainsFunc(seg, unicode.IsControl) {
+			return "", fmt.Errorf("%q is not a valid file name", name)
+		}
+		clean = append(clean, seg)
+	}
+	if len(clean) > maxPathDepth {
+		return "", fmt.Errorf("%s is nested too deeply", name)
+	}
+	return strings.Join(clean, "/"), nil
+}
+
+// bundleDir is the directory holding a bundle's files, named by number.
+func bundleDir(key string) string {
+	return blobPath(key)
+}
+
+func bundleFilePath(key string, n int) string {
+	return filepath.Join(bundleDir(key), strconv.Itoa(n))
+}
+
+// uniqueName renames name if it is already taken, as "notes (2).txt", so
+// every file in a bundle and its zip has its own name.
+func uniqueName(name string, taken map[string]bool) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	taken[name] = true
+	return name
+}
+
+// saveBundle publishes staged files as one bundle, set up like
+// saveUploadedFile's entry. The staging directory becomes the bundle's
+// directory.
+func saveBundle(r *http.Request, staging string, files []stagedFile, bundle Share) (string, error) {
+	bundle.Kind = KindBundle
+	taken := make(map[string]bool)
+	for _, f := range files {
+		bundle.Files = append(bundle.Files, BundleFile{Name: uniqueName(f.Name, taken), Size: f.Size})
+		bundle.Size += f.Size
+	}
+
+	bundle.Key = newStorageKey()
+	if err := makeBlobDir(bundle.Key); err != nil {
+		slog.Error("Failed to store bundle", "path", staging, "err", err)
+		return "", fmt.Errorf("failed to store the upload")
+	}
+
+	entriesMu.Lock()
+	id, err := claimID(bundle.ID)
+	if err != nil {
+		entriesMu.Unlock()
+		return "", err
+	}
+	if err := os.Rename(staging, bundleDir(bundle.Key)); err != nil {
+		entriesMu.Unlock()
+		slog.Error("Failed to store bundle", "path", staging, "err", err)
+		return "", fmt.Errorf("failed to store the upload")
+	}
+	bundle.ID = id
+	if err := addShare(r, bundle, "files", len(files), "bytes", bundle.Size); err != nil {
+		entriesMu.Unlock()
+		return "", fmt.Errorf("failed to store the upload")
+	}
+	entriesMu.Unlock()
+	return id, nil
+}
+
+// removeBundleFiles deletes a bundle's directory, releasing its bytes.
+func removeBundleFiles(entry Share) {
+	for n := range entry.Files {
+		path := bundleFilePath(entry.Key, n)
+		if err := removeUpload(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed to remove bundle file", "path", path, "err", err)
+		}
+	}
+	if err := os.Remove(bundleDir(entry.Key)); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove bundle directory", "path", bundleDir(entry.Key), "err", err)
+	}
+}
+
+// bundleNode is a file or folder on the bundle page.
+type bundleNode struct {
+	Name      string
+	Href      string // files only
+	SizeLabel string
+	Preview   string // start of a text file
+	Image     bool   // shown inline
+
+	// Folders only
+	Children []*bundleNode
+	Files    int
+
+	size int64
+}
+
+// bundleTree arranges a bundle's files by their paths, folders first.
+func bundleTree(entry Share) *bundleNode {
+	root := &bundleNode{}
+	dirs := map[string]*bundleNode{"": root}
+	for n, f := range entry.Files {
+		parent, dirPath := root, ""
+		segments := strings.Split(f.Name, "/")
+		for _, seg := range segments[:len(segments)-1] {
+			dirPath += seg + "/"
+			dir := dirs[dirPath]
+			if dir == nil {
+				dir = &bundleNode{Name: seg}
+				dirs[dirPath] = dir
+				parent.Children = append(parent.Children, dir)
+			}
+			parent = dir
+		}
+		node := &bundleNode{
+			Name:      segments[len(segments)-1],
+			Href:      fmt.Sprintf("/b/%s/%d", entry.ID, n),
+			SizeLabel: formatBytes(f.Size),
+			size:      f.Size,
+		}
+		if n < maxPreviews {
+			if _, ok := previewImages[strings.ToLower(filepath.Ext(f.Name))]; ok {
+				node.Image = true
+			} else {
+				node.Preview = filePreview(bundleFilePath(entry.Key, n))
+			}
+		}
+		parent.Children = append(parent.Children, node)
+	}
+	root.sortAndCount()
+	return root
+}
+
+// Count describes how many files a folder holds.
+func (d *bundleNode) Count() string {
+	if d.Files == 1 {
+		return "1 file"
+	}
+	return fmt.Sprintf("%d files", d.Files)
+}
+
+// sortAndCount orders a folder's contents and totals up its files.
+func (d *bundleNode) sortAndCount() {
+	sort.SliceStable(d.Children, func(i, j int) bool {
+		a, b := d.Children[i], d.Children[j]
+		if (a.Href == "") != (b.Href == "") {
+			return a.Href == ""
+		}
+		return a.Name < b.Name
+	})
+	for _, c := range d.Children {
+		if c.Href == "" {
+			c.sortAndCount()
+			c.SizeLabel = formatBytes(c.size)
+			d.Files += c.Files
+		} else {
+			d.Files++
+		}
+		d.size += c.size
+	}
+}
+
+// filePreview returns the start of a stored file if it looks like text.
+func filePreview(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+	if n == 0 || bytes.IndexByte(buf, 0) >= 0 {
+		return ""
+	}
+	// Don't reject a file just because the read cut a character in half
+	for i := 0; i < utf8.UTFMax && len(buf) > 0 && !utf8.Valid(buf); i++ {
+		buf = buf[:len(buf)-1]
+	}
+	if !utf8.Valid(buf) {
+		return ""
+	}
+	lines := strings.SplitN(string(buf), "\n", 11)
+	if len(lines) > 10 {
+		lines = append(lines[:10], "…")
+	}
+	return textPreview(strings.Join(lines, "\n"))
+}
+
+// bundleHandler serves /b/{id}, the bundle page, /b/{id}/{n}, one of its
+// files, and /b/{id}/zip and /b/{id}/tar.gz, all of them as an archive.
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/b/"), "/")
+	if id == "" {
+		http.Error(w, "Invalid bundle ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, exists := getShare(KindBundle, id)
+	if !exists {
+		http.Error(w, "Bundle not found or expired", http.StatusNotFound)
+		return
+	}
+
+	switch rest {
+	case "":
+		bundlePage(w, r, entry)
+	case "zip":
+		bundleZip(w, r, entry)
+	case "tar.gz":
+		bundleTarGz(w, r, entry)
+	default:
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 || n >= len(entry.Files) || strconv.Itoa(n) != rest {
+			http.NotFound(w, r)
+			return
+		}
+		bundleFile(w, r, entry, n)
+	}
+}
+
+func bundlePage(w http.ResponseWriter, r *http.Request, entry Share) {
+	countView(entry)
+	render(w, "bundle.html", struct {
+		ID        string
+		URL       string
+		TimeLeft  string
+		CreatedAt time.Time
+		SizeLabel string
+		Tree      *bundleNode
+	}{
+		ID:        entry.ID,
+		URL:       r.Host + r.URL.Path,
+		TimeLeft:  formatDuration(time.Until(entry.ExpiresAt)),
+		CreatedAt: entry.CreatedAt,
+		SizeLabel: formatBytes(entry.Size),
+		Tree:      bundleTree(entry),
+	})
+}
+
+// bundleFile serves one file as a download, or inline for image previews.
+func bundleFile(w http.ResponseWriter, r *http.Request, entry Share, n int) {
+	f := entry.Files[n]
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") != "" {
+		typ, ok := previewImages[strings.ToLower(filepath.Ext(f.Name))]
+		if !ok {
+			http.Error(w, "Only images can be shown inline", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", typ)
+		disposition = "inline"
+	} else {
+		countView(entry)
+		audit(r, "downloaded", "bundle", entry.ID, "filename", f.Name)
+	}
+
+	sandboxUserContent(w)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(f.Name)}))
+	http.ServeFile(w, r, bundleFilePath(entry.Key, n))
+}
+
+// bundleZip streams every file in a bundle as one zip, built as it is
+// sent, so nothing is written to disk.
+func bundleZip(w http.ResponseWriter, r *http.Request, entry Share) {
+	countView(entry)
+	audit(r, "downloaded", "bundle", entry.ID, "filename", entry.ID+".zip")
+
+	sandboxUserContent(w)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": entry.ID + ".zip"}))
+
+	zw := zip.NewWriter(w)
+	for n, f := range entry.Files {
+		if err := addZipFile(zw, bundleFilePath(entry.Key, n), f.Name, entry.CreatedAt); err != nil {
+			// Headers are gone by now; all we can do is cut the zip short
+			slog.Warn("Failed to stream bundle", "id", entry.ID, "file", f.Name, "err", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.Warn("Failed to stream bundle", "id", entry.ID, "err", err)
+	}
+}
+
+func addZipFile(zw *zip.Writer, path, name string, modified time.Time) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified}
+	if storedCompressed[strings.ToLower(filepath.Ext(name))] {
+		header.Method = zip.Store
+	}
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// bundleTarGz streams every file in a bundle as a gzipped tar, the same way
+// bundleZip does.
+func bundleTarGz(w http.ResponseWriter, r *http.Request, entry Share) {
+	countView(entry)
+	audit(r, "downloaded", "bundle", entry.ID, "filename", entry.ID+".tar.gz")
+
+	sandboxUserContent(w)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": entry.ID + ".tar.gz"}))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for n, f := range entry.Files {
+		if err := addTarFile(tw, bundleFilePath(entry.Key, n), f, entry.CreatedAt); err != nil {
+			slog.Warn("Failed to stream bundle", "id", entry.ID, "file", f.Name, "err", err)
+			return
+		}
+	}
+	err := tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		slog.Warn("Failed to stream bundle", "id", entry.ID, "err", err)
+	}
+}
+
+func addTarFile(tw *tar.Writer, path string, f BundleFile, modified time.Time) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     f.Name,
+		Size:     f.Size,
+		Mode:     0644,
+		ModTime:  modified,
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, src)
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanUploadPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"":                     "",
+		"notes.txt":            "notes.txt",
+		"photos/2024/a.jpg":    "photos/2024/a.jpg",
+		"/etc/passwd":          "etc/passwd",
+		"./a/./b//c":           "a/b/c",
+		`C:\Users\me\file.txt`: "Users/me/file.txt",
+		`docs\readme.md`:       "docs/readme.md",
+		"C:":                   "C:",
+		"naïve café.txt":       "naïve café.txt",
+		"a..b/..c":             "a..b/..c",
+	} {
+		got, err := cleanUploadPath(name)
+		if err != nil || got != want {
+			t.Errorf("cleanUploadPath(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+
+	for _, name := range []string{
+		"../secret",
+		"a/../../b",
+		"a/..",
+		`..\..\windows\system32`,
+		"C:/../x",
+		"line\nbreak.txt",
+		"nul\x00.txt",
+		"bad\xffutf8",
+		strings.Repeat("d/", maxPathDepth) + "file",
+	} {
+		if got, err := cleanUploadPath(name); err == nil {
+			t.Errorf("cleanUploadPath(%q) = %q, want an error", name, got)
+		}
+	}
+
+	if _, err := cleanUploadPath(strings.Repeat("d/", maxPathDepth-1) + "file"); err != nil {
+		t.Errorf("path at the depth limit refused: %v", err)
+	}
+}
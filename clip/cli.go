@@ -0,0 +1,501 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Besides serving, the binary runs maintenance commands against the
+// working directory's uploads/ and the metadata store, so the volume behind
+// a deployment can be managed with the server scaled down. Commands that
+// only read (ls, stats, export, fsck without -repair) also work beside a
+// running server; the rest need it stopped, and say so if it isn't.
+
+type command struct {
+	name, args, help string
+	run              func(args []string) int // nil for serve
+}
+
+var commands = []command{
+	{"serve", "[flags]", "run the server (the default)", nil},
+	{"ls", "[-kind k] [-owner ip] [-expired] [-json]", "list shares", lsCommand},
+	{"rm", "id...", "delete shares and their files", rmCommand},
+	{"purge", "-expired", "delete every share past its expiry", purgeCommand},
+	{"fsck", "[-repair]", "find files without shares and shares without files", runFsck},
+	{"export", "[filters] [-o file]", "write shares and their files as a tar stream", exportCommand},
+	{"import", "[-i file]", "restore shares from an export", importCommand},
+	{"stats", "", "count shares and bytes by kind", statsCommand},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: clip [flags] [command [args]]\n\nCommands:")
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.help)
+	}
+	tw.Flush()
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a command other than serve and returns its exit code.
+func runCommand(name string, args []string) int {
+	for _, c := range commands {
+		if c.name == name && c.run != nil {
+			return c.run(args)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "clip: unknown command %q\n", name)
+	flag.Usage()
+	return 2
+}
+
+// commandFlags starts a command's flag set. -meta-dir is accepted after
+// the command name as well as before it.
+func commandFlags(name, args string) *flag.FlagSet {
+	fset := flag.NewFlagSet(name, flag.ExitOnError)
+	fset.StringVar(&metaDir, "meta-dir", metaDir, "directory for the share metadata log and snapshot")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: clip %s %s\n", name, args)
+		fset.PrintDefaults()
+	}
+	return fset
+}
+
+// openStore opens the metadata store for a command that changes it, and
+// loads its shares so removeShare and friends work as in the server.
+func openStore() bool {
+	var err error
+	store, shares, err = openMetaStore(metaDir)
+	if errors.Is(err, errStoreLocked) {
+		fmt.Fprintln(os.Stderr, "clip: stop the server first;", err)
+		return false
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "clip: opening the metadata store:", err)
+		return false
+	}
+	return true
+}
+
+// readShares loads the shares for a command that only looks.
+func readShares() (map[string]Share, bool) {
+	all, err := readMetaStore(metaDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "clip: reading the metadata store:", err)
+		return nil, false
+	}
+	return all, true
+}
+
+// byCreation lists shares oldest first.
+func byCreation(all map[string]Share) []Share {
+	list := make([]Share, 0, len(all))
+	for _, s := range all {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// shareFilter selects shares for ls and export.
+type shareFilter struct {
+	kind    string
+	owner   string
+	expired bool
+}
+
+func (f *shareFilter) register(fset *flag.FlagSet) {
+	fset.StringVar(&f.kind, "kind", "", "only shares of this kind: text, file or bundle")
+	fset.StringVar(&f.owner, "owner", "", "only shares created from this IP address")
+	fset.BoolVar(&f.expired, "expired", false, "only shares past their expiry")
+}
+
+func (f *shareFilter) match(s Share) bool {
+	return (f.kind == "" || string(s.Kind) == f.kind) &&
+		(f.owner == "" || s.Owner == f.owner) &&
+		(!f.expired || s.Expired())
+}
+
+func lsCommand(args []string) int {
+	fset := commandFlags("ls", "[flags]")
+	var filter shareFilter
+	filter.register(fset)
+	asJSON := fset.Bool("json", false, "print one JSON object per share")
+	fset.Parse(args)
+
+	all, ok := readShares()
+	if !ok {
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !*asJSON {
+		fmt.Fprintln(tw, "ID\tKIND\tSIZE\tVIEWS\tCREATED\tEXPIRES\tOWNER\tNAME")
+	}
+	for _, s := range byCreation(all) {
+		if !filter.match(s) {
+			continue
+		}
+		name := s.Label()
+		if s.Kind == KindText {
+			name = s.Language
+		}
+		if *asJSON {
+			enc.Encode(struct {
+				ID        string    `json:"id"`
+				Kind      ShareKind `json:"kind"`
+				Name      string    `json:"name,omitempty"`
+				Size      int64     `json:"size"`
+				Views     int       `json:"views"`
+				CreatedAt time.Time `json:"created_at"`
+				ExpiresAt time.Time `json:"expires_at"`
+				Owner     string    `json:"owner"`
+			}{s.ID, s.Kind, name, s.Size, s.Views, s.CreatedAt, s.ExpiresAt, s.Owner})
+			continue
+		}
+		expires := s.ExpiresAt.Local().Format("2006-01-02 15:04")
+		if s.Expired() {
+			expires = "expired"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", s.ID, s.Kind, formatBytes(s.Size), s.Views,
+			s.CreatedAt.Local().Format("2006-01-02 15:04"), expires, s.Owner, name)
+	}
+	tw.Flush()
+	return 0
+}
+
+func rmCommand(args []string) int {
+	fset := commandFlags("rm", "id...")
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return 2
+	}
+	if !openStore() {
+		return 2
+	}
+	defer store.close()
+
+	code := 0
+	for _, id := range fset.Args() {
+		s, ok := shares[id]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "clip: no share %q\n", id)
+			code = 1
+			continue
+		}
+		removeShare(s)
+		fmt.Printf("removed %s %s\n", s.Kind, id)
+	}
+	return code
+}
+
+func purgeCommand(args []string) int {
+	fset := commandFlags("purge", "-expired")
+	expired := fset.Bool("expired", false, "delete shares past their expiry")
+	fset.Parse(args)
+	if !*expired {
+		fmt.Fprintln(os.Stderr, "clip purge: say what to purge, e.g. -expired")
+		return 2
+	}
+	if !openStore() {
+		return 2
+	}
+	defer store.close()
+
+	var n int
+	var size int64
+	for _, s := range byCreation(shares) {
+		if s.Expired() {
+			removeShare(s)
+			n++
+			size += s.Size
+		}
+	}
+	fmt.Printf("purged %d expired shares, %s\n", n, formatBytes(size))
+	return 0
+}
+
+// An export has a directory per share holding its files, named as in
+// shareBlobs, followed by share.json with its metadata. The metadata comes
+// last so an import knows a share is complete when it arrives.
+
+func exportCommand(args []string) int {
+	fset := commandFlags("export", "[flags]")
+	var filter shareFilter
+	filter.register(fset)
+	out := fset.String("o", "", "write to this file instead of standard output")
+	fset.Parse(args)
+
+	all, ok := readShares()
+	if !ok {
+		return 2
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "clip:", err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+	}
+
+	tw := tar.NewWriter(w)
+	n := 0
+	for _, s := range byCreation(all) {
+		if !filter.match(s) {
+			continue
+		}
+		if err := exportShare(tw, s); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted by the running server as we went
+				fmt.Fprintf(os.Stderr, "clip: skipping %s: %v\n", s.ID, err)
+				continue
+			}
+			fmt.Fprintln(os.Stderr, "clip:", err)
+			return 1
+		}
+		n++
+	}
+	if err := tw.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "clip:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d shares\n", n)
+	return 0
+}
+
+func exportShare(tw *tar.Writer, s Share) error {
+	for _, b := range shareBlobs(s) {
+		f, err := os.Open(b.Path)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: s.ID + "/" + b.Name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The importer picks a new storage key
+	s.Key = ""
+	meta, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: s.ID + "/share.json", Mode: 0644, Size: int64(len(meta)), ModTime: s.CreatedAt}); err != nil {
+		return err
+	}
+	_, err = tw.Write(meta)
+	return err
+}
+
+func importCommand(args []string) int {
+	fset := commandFlags("import", "[flags]")
+	in := fset.String("i", "", "read from this file instead of standard input")
+	fset.Parse(args)
+
+	r := io.Reader(os.Stdin)
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "clip:", err)
+			return 2
+		}
+		defer f.Close()
+		r = f
+	}
+	if !openStore() {
+		return 2
+	}
+	defer store.close()
+
+	code := 0
+	keys := make(map[string]string) // storage keys of shares being read
+	skipped := make(map[string]bool)
+	skip := func(id, why string) {
+		fmt.Fprintf(os.Stderr, "clip: skipping %s: %s\n", id, why)
+		if key, ok := keys[id]; ok {
+			removeKeyFiles(key)
+			delete(keys, id)
+		}
+		skipped[id] = true
+		code = 1
+	}
+
+	n := 0
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "clip: reading the export:", err)
+			code = 1
+			break
+		}
+		id, name, ok := strings.Cut(hdr.Name, "/")
+		if !ok || hdr.Typeflag != tar.TypeReg || skipped[id] {
+			continue
+		}
+		key, ok := keys[id]
+		if !ok {
+			if clean, err := cleanSlug(id); err != nil || clean != id {
+				skip(id, "not a valid ID")
+				continue
+			}
+			if idTaken(id) {
+				skip(id, "a share with this ID already exists")
+				continue
+			}
+			key = newStorageKey()
+			keys[id] = key
+		}
+
+		if name == "share.json" {
+			var s Share
+			if err := json.NewDecoder(tr).Decode(&s); err != nil {
+				skip(id, err.Error())
+				continue
+			}
+			s.ID, s.Key, s.Room = id, key, ""
+			if s.Thumbnail != "" {
+				s.Thumbnail = blobName(key) + ".thumb" + filepath.Ext(s.Thumbnail)
+			}
+			if s.Kind.urlType() == "" || !checkShare(s) {
+				skip(id, "incomplete")
+				continue
+			}
+			if err := store.put(s); err != nil {
+				fmt.Fprintln(os.Stderr, "clip:", err)
+				return 1
+			}
+			shares[id] = s
+			delete(keys, id)
+			n++
+			continue
+		}
+
+		path, ok := blobPathFor(key, name)
+		if !ok {
+			skip(id, "unexpected file "+name)
+			continue
+		}
+		if err := writeImported(path, tr); err != nil {
+			fmt.Fprintln(os.Stderr, "clip:", err)
+			return 1
+		}
+	}
+
+	for id := range keys {
+		skip(id, "the export ends before its share.json")
+	}
+	fmt.Fprintf(os.Stderr, "imported %d shares\n", n)
+	return code
+}
+
+func writeImported(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func statsCommand(args []string) int {
+	fset := commandFlags("stats", "")
+	fset.Parse(args)
+
+	all, ok := readShares()
+	if !ok {
+		return 2
+	}
+	type tally struct {
+		count, expired int
+		size           int64
+	}
+	kinds := []ShareKind{KindText, KindFile, KindBundle}
+	byKind := make(map[ShareKind]*tally)
+	for _, k := range kinds {
+		byKind[k] = &tally{}
+	}
+	var total tally
+	for _, s := range all {
+		t := byKind[s.Kind]
+		if t == nil {
+			continue
+		}
+		for _, t := range []*tally{t, &total} {
+			t.count++
+			t.size += s.Size
+			if s.Expired() {
+				t.expired++
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tSHARES\tEXPIRED\tBYTES")
+	for _, k := range kinds {
+		t := byKind[k]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", k, t.count, t.expired, formatBytes(t.size))
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t%s\n", total.count, total.expired, formatBytes(total.size))
+	tw.Flush()
+
+	fmt.Println()
+	for _, dir := range []string{"uploads", metaDir} {
+		files, size := dirUsage(dir)
+		fmt.Printf("%s: %s in %d files\n", dir, formatBytes(size), files)
+	}
+	return 0
+}
+
+// dirUsage counts the regular files under dir and their bytes.
+func dirUsage(dir string) (files int, size int64) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				files++
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return files, size
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// After a share is created the creator lands on /created/{type}/{id}, which
+// has everything they need to pass it on or take it back: the link, a QR
+// code, when it expires and its manage token. Clients asking for JSON get
+// the same details straight from the create request.
+
+// shareLink is one URL on the result page.
+type shareLink struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+type createdShare struct {
+	Type        string      `json:"type"` // "text", "file" or "bundle"
+	ID          string      `json:"id"`
+	Name        string      `json:"name,omitempty"`
+	URL         string      `json:"url"`
+	Links       []shareLink `json:"links,omitempty"`
+	QRCode      string      `json:"qr_code"`
+	QRCodePNG   string      `json:"qr_code_png"`
+	ExpiresAt   time.Time   `json:"expires_at"`
+	DeleteURL   string      `json:"delete_url"`
+	ManageToken string      `json:"manage_token"`
+
+	path string // "c/{id}" and so on
+}
+
+// shareURL is the absolute URL of /{typ}/{id} as the client reached us.
+func shareURL(r *http.Request, typ, id string) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/" + typ + "/" + id
+}
+
+// describeCreated gathers the result page's details for a share of URL
+// type typ, if the token proves r created it.
+func describeCreated(r *http.Request, typ, id, token string) (createdShare, bool) {
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+
+	s := createdShare{ID: id, path: typ + "/" + id, ManageToken: token}
+	entry, ok := findShare(shareKinds[typ], id)
+	if !ok || !tokenMatches(token, entry.ManageTokenHash) {
+		return s, false
+	}
+	s.Type = string(entry.Kind)
+	switch entry.Kind {
+	case KindText:
+		if !entry.Live() {
+			s.Links = []shareLink{{"Raw text", shareURL(r, typ, id) + "/raw"}}
+		}
+	case KindFile:
+		s.Name = entry.Filename
+		s.Links = []shareLink{{"Download", shareURL(r, typ, id) + "?download=1"}}
+	case KindBundle:
+		s.Name = entry.Label()
+		s.Links = []shareLink{
+			{"Download all as zip", shareURL(r, typ, id) + "/zip"},
+			{"Download all as tar.gz", shareURL(r, typ, id) + "/tar.gz"},
+		}
+	}
+
+	s.URL = shareURL(r, typ, id)
+	base := strings.TrimSuffix(s.URL, s.path)
+	s.QRCode = base + "qr/" + s.path + ".svg"
+	s.QRCodePNG = base + "qr/" + s.path + ".png"
+	s.DeleteURL = base + "delete/" + s.path
+	s.ExpiresAt = entry.ExpiresAt
+	return s, true
+}
+
+// shareCreated answers a successful create request: JSON for clients that
+// ask for it, otherwise a redirect to the result page. Either way the
+// creator also gets the token in a cookie.
+func shareCreated(w http.ResponseWriter, r *http.Request, typ, id, token string) {
+	giveManageToken(w, r, id, token)
+	if r.Header.Get("Accept") == "application/json" {
+		s, ok := describeCreated(r, typ, id, token)
+		if !ok {
+			http.Error(w, "Share not found or expired", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusCreated, s)
+		return
+	}
+	http.Redirect(w, r, "/created/"+typ+"/"+id, http.StatusSeeOther)
+}
+
+// createdHandler serves /created/{type}/{id}. Only the creator can see it;
+// anyone else is sent on to the share itself.
+func createdHandler(w http.ResponseWriter, r *http.Request) {
+	typ, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/created/"), "/")
+	s, ok := describeCreated(r, typ, id, manageToken(r, id))
+	if !ok {
+		if shareExists(typ, id) {
+			http.Redirect(w, r, "/"+typ+"/"+id, http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Share not found or expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Header.Get("Accept") == "application/json" {
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	render(w, "created.html", struct {
+		createdShare
+		Path      string
+		TimeLeft  string
+		CSRFToken string
+	}{
+		createdShare: s,
+		Path:         s.path,
+		TimeLeft:     formatDuration(time.Until(s.ExpiresAt)),
+		CSRFToken:    csrfToken(w, r),
+	})
+}
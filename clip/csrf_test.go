@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testCSRFToken = "0123456789abcdef0123456789abcdef0123456789a"
+
+func TestCSRFProtect(t *testing.T) {
+	protected := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	form := url.Values{"csrf_token": {testCSRFToken}}.Encode()
+
+	for _, tt := range []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers map[string]string
+		cookie  bool
+		allowed bool
+	}{
+		{"get needs nothing", "GET", "/", "", nil, false, true},
+		{"header token", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken}, true, true},
+		{"query token", "POST", "/upload?csrf_token=" + testCSRFToken, "", nil, true, true},
+		{"form token", "POST", "/delete/c/x", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, true, true},
+		{"same origin", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken, "Origin": "http://example.com", "Sec-Fetch-Site": "same-origin"}, true, true},
+		{"bearer token", "POST", "/c/x/edit", "", map[string]string{"Authorization": "Bearer abc", "Sec-Fetch-Site": "cross-site"}, false, true},
+
+		{"no token", "POST", "/delete/c/x", "", nil, true, false},
+		{"no cookie", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken}, false, false},
+		{"wrong token", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken[1:] + "x"}, true, false},
+		{"token in a multipart body", "POST", "/delete/c/x", form, map[string]string{"Content-Type": "multipart/form-data; boundary=x"}, true, false},
+		{"cross-site fetch", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken, "Sec-Fetch-Site": "cross-site"}, true, false},
+		{"same-site fetch", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken, "Sec-Fetch-Site": "same-site"}, true, false},
+		{"other origin", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken, "Origin": "http://evil.example"}, true, false},
+		{"null origin", "POST", "/delete/c/x", "", map[string]string{"X-CSRF-Token": testCSRFToken, "Origin": "null"}, true, false},
+		{"delete method", "DELETE", "/c/x", "", nil, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if tt.cookie {
+				r.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFToken})
+			}
+			w := httptest.NewRecorder()
+			protected.ServeHTTP(w, r)
+			if allowed := w.Code == http.StatusNoContent; allowed != tt.allowed {
+				t.Errorf("status %d, want allowed=%v", w.Code, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	token := csrfToken(w, r)
+	cookies := w.Result().Cookies()
+	if len(token) < 32 || len(cookies) != 1 || cookies[0].Value != token {
+		t.Fatalf("issued %q with cookies %v", token, cookies)
+	}
+	if c := cookies[0]; !c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie isn't HttpOnly and SameSite=Strict: %v", c)
+	}
+	// A page rendered later in the same request sees the same token
+	if again := csrfToken(httptest.NewRecorder(), r); again != token {
+		t.Errorf("second call gave %q, want %q", again, token)
+	}
+
+	// A browser that has one keeps it; a short one is replaced
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFToken})
+	w = httptest.NewRecorder()
+	if got := csrfToken(w, r); got != testCSRFToken || len(w.Result().Cookies()) != 0 {
+		t.Errorf("existing token replaced with %q", got)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "short"})
+	if got := csrfToken(httptest.NewRecorder(), r); got == "short" {
+		t.Error("kept a token too short to be one of ours")
+	}
+}
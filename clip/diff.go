@@ -0,0 +1,189 @@
+package main
+
+import "strings"
+
+// Line diffs between revisions, using Myers' O(ND) algorithm.
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+	diffSkip // unchanged lines left out of the output
+)
+
+// diffLine is one line of a diff. OldN and NewN are 1-based line numbers,
+// zero on the side the line is absent from.
+type diffLine struct {
+	Op         diffOp
+	OldN, NewN int
+	Text       string
+}
+
+func (l diffLine) Class() string {
+	switch l.Op {
+	case diffDelete:
+		return "del"
+	case diffInsert:
+		return "add"
+	case diffSkip:
+		return "skip"
+	}
+	return "ctx"
+}
+
+// maxDiffEdits bounds the work done for very different texts; beyond it the
+// whole old text is shown as removed and the new one as added.
+const maxDiffEdits = 2000
+
+// diffLines returns the edit script turning a into b.
+func diffLines(a, b []string) []diffLine {
+	// Common prefix and suffix need no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var out []diffLine
+	for i := 0; i < prefix; i++ {
+		out = append(out, diffLine{Op: diffEqual, OldN: i + 1, NewN: i + 1, Text: a[i]})
+	}
+	for _, l := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		if l.OldN > 0 {
+			l.OldN += prefix
+		}
+		if l.NewN > 0 {
+			l.NewN += prefix
+		}
+		out = append(out, l)
+	}
+	for i := suffix; i > 0; i-- {
+		out = append(out, diffLine{Op: diffEqual, OldN: len(a) - i + 1, NewN: len(b) - i + 1, Text: a[len(a)-i]})
+	}
+	return out
+}
+
+func myers(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] holds v[-d..d] after round d, for walking the path back
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && d <= maxDiffEdits && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	if !found {
+		var out []diffLine
+		for i, line := range a {
+			out = append(out, diffLine{Op: diffDelete, OldN: i + 1, Text: line})
+		}
+		for i, line := range b {
+			out = append(out, diffLine{Op: diffInsert, NewN: i + 1, Text: line})
+		}
+		return out
+	}
+
+	var rev []diffLine
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			rev = append(rev, diffLine{Op: diffEqual, OldN: x + 1, NewN: y + 1, Text: a[x]})
+		}
+		if x == prevX {
+			y--
+			rev = append(rev, diffLine{Op: diffInsert, NewN: y + 1, Text: b[y]})
+		} else {
+			x--
+			rev = append(rev, diffLine{Op: diffDelete, OldN: x + 1, Text: a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		rev = append(rev, diffLine{Op: diffEqual, OldN: x + 1, NewN: y + 1, Text: a[x]})
+	}
+
+	out := make([]diffLine, len(rev))
+	for i, l := range rev {
+		out[len(rev)-1-i] = l
+	}
+	return out
+}
+
+// collapseDiff keeps context lines of unchanged text around each change and
+// replaces longer unchanged runs with a single diffSkip line.
+func collapseDiff(lines []diffLine, context int) []diffLine {
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.Op == diffEqual {
+			continue
+		}
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+	var out []diffLine
+	for i, l := range lines {
+		switch {
+		case keep[i]:
+			out = append(out, l)
+		case len(out) == 0 || out[len(out)-1].Op != diffSkip:
+			out = append(out, diffLine{Op: diffSkip})
+		}
+	}
+	return out
+}
+
+// splitLines splits text into lines, ignoring a final newline.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
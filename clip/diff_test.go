@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkDiff verifies that lines turns a into b with consistent line numbers.
+func checkDiff(t *testing.T, a, b []string, lines []diffLine) {
+	t.Helper()
+	var before, after []string
+	for _, l := range lines {
+		switch l.Op {
+		case diffEqual:
+			before, after = append(before, l.Text), append(after, l.Text)
+			if l.OldN != len(before) || l.NewN != len(after) {
+				t.Fatalf("%q numbered %d/%d, want %d/%d", l.Text, l.OldN, l.NewN, len(before), len(after))
+			}
+		case diffDelete:
+			before = append(before, l.Text)
+			if l.OldN != len(before) || l.NewN != 0 {
+				t.Fatalf("removed %q numbered %d/%d, want %d/0", l.Text, l.OldN, l.NewN, len(before))
+			}
+		case diffInsert:
+			after = append(after, l.Text)
+			if l.NewN != len(after) || l.OldN != 0 {
+				t.Fatalf("added %q numbered %d/%d, want 0/%d", l.Text, l.OldN, l.NewN, len(after))
+			}
+		}
+	}
+	if strings.Join(before, "\n") != strings.Join(a, "\n") || strings.Join(after, "\n") != strings.Join(b, "\n") {
+		t.Fatalf("diff gives %q -> %q, want %q -> %q", before, after, a, b)
+	}
+}
+
+func countOps(lines []diffLine) (deleted, inserted int) {
+	for _, l := range lines {
+		switch l.Op {
+		case diffDelete:
+			deleted++
+		case diffInsert:
+			inserted++
+		}
+	}
+	return
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, tt := range []struct {
+		a, b              string
+		deleted, inserted int
+	}{
+		{"", "", 0, 0},
+		{"a\nb\nc", "a\nb\nc", 0, 0},
+		{"", "a\nb", 0, 2},
+		{"a\nb", "", 2, 0},
+		{"a\nb\nc", "a\nx\nc", 1, 1},
+		{"a\nb\nc\nd", "a\nc\nd\ne", 1, 1},
+		{"x\na\nb\nc\ny", "a\nb\nc", 2, 0},
+		{"a\nb\na\nb", "b\na\nb\na", 1, 1},
+	} {
+		a, b := splitLines(tt.a), splitLines(tt.b)
+		lines := diffLines(a, b)
+		checkDiff(t, a, b, lines)
+		if d, i := countOps(lines); d != tt.deleted || i != tt.inserted {
+			t.Errorf("%q -> %q: %d removed and %d added, want %d and %d", tt.a, tt.b, d, i, tt.deleted, tt.inserted)
+		}
+	}
+}
+
+func TestDiffLinesGivesUp(t *testing.T) {
+	// Texts with nothing in common need more than maxDiffEdits edits; the
+	// diff then replaces one with the other wholesale
+	var a, b []string
+	for i := 0; i < maxDiffEdits; i++ {
+		a = append(a, fmt.Sprintf("old %d", i))
+		b = append(b, fmt.Sprintf("new %d", i))
+	}
+	a = append(a, "shared")
+	b = append(b, "shared")
+	lines := diffLines(a, b)
+	checkDiff(t, a, b, lines)
+	if d, i := countOps(lines); d != maxDiffEdits || i != maxDiffEdits {
+		t.Errorf("%d removed and %d added, want %d of each", d, i, maxDiffEdits)
+	}
+}
+
+func TestCollapseDiff(t *testing.T) {
+	var a []string
+	for i := 1; i <= 20; i++ {
+		a = append(a, fmt.Sprint(i))
+	}
+	b := append([]string(nil), a...)
+	b[9] = "ten"
+	got := collapseDiff(diffLines(a, b), 2)
+	var summary []string
+	for _, l := range got {
+		summary = append(summary, l.Class()+":"+l.Text)
+	}
+	want := []string{"skip:", "ctx:8", "ctx:9", "del:10", "add:ten", "ctx:11", "ctx:12", "skip:"}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("collapsed to %q, want %q", summary, want)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	for in, want := range map[string][]string{
+		"":           nil,
+		"a":          {"a"},
+		"a\n":        {"a"},
+		"a\r\nb\r\n": {"a", "b"},
+		"a\n\nb":     {"a", "", "b"},
+		"\n":         {""},
+	} {
+		if got := splitLines(in); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitLines(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// diskFree is not implemented on this platform; only the max-storage limit
+// applies.
+func diskFree(path string) (int64, bool) {
+	return 0, false
+}
+
+// syncDir is a no-op here; renames are as durable as the platform makes
+// them.
+func syncDir(dir string) error {
+	return nil
+}
+
+// lockFile is a no-op here, so nothing stops two processes writing the
+// metadata store at once.
+func lockFile(f *os.File) error {
+	return nil
+}
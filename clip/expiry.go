@@ -0,0 +1,178 @@
+package main
+
+import (
+	"container/heap"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Shares and rooms are removed at their exact expiry time. The scheduler
+// keeps every deadline in a min-heap keyed by ID, which is unique across
+// shares and rooms, so adding, moving or cancelling one is O(log N). The
+// cleanup routine sleeps until the earliest deadline, or until a sooner one
+// is scheduled. At startup the deadlines are rebuilt from the metadata
+// store.
+
+type deadline struct {
+	id    string
+	at    time.Time
+	index int // in the heap
+}
+
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x any) {
+	d := x.(*deadline)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return d
+}
+
+type expiryScheduler struct {
+	mu    sync.Mutex
+	queue deadlineHeap
+	byID  map[string]*deadline
+	// wake interrupts the cleanup routine's sleep when the earliest
+	// deadline moves up.
+	wake chan struct{}
+}
+
+var expiries = &expiryScheduler{
+	byID: make(map[string]*deadline),
+	wake: make(chan struct{}, 1),
+}
+
+// schedule sets id to expire at at, replacing any earlier deadline.
+func (s *expiryScheduler) schedule(id string, at time.Time) {
+	s.mu.Lock()
+	d := s.byID[id]
+	switch {
+	case d == nil:
+		d = &deadline{id: id, at: at}
+		heap.Push(&s.queue, d)
+		s.byID[id] = d
+	case !d.at.Equal(at):
+		d.at = at
+		heap.Fix(&s.queue, d.index)
+	default:
+		s.mu.Unlock()
+		return
+	}
+	soonest := s.queue[0] == d
+	s.mu.Unlock()
+	if soonest {
+		s.poke()
+	}
+}
+
+// cancel forgets id's deadline, if it has one.
+func (s *expiryScheduler) cancel(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.byID[id]; d != nil {
+		heap.Remove(&s.queue, d.index)
+		delete(s.byID, id)
+	}
+}
+
+// due removes and returns the IDs whose deadlines have passed by now,
+// soonest first.
+func (s *expiryScheduler) due(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for len(s.queue) > 0 && !s.queue[0].at.After(now) {
+		d := heap.Pop(&s.queue).(*deadline)
+		delete(s.byID, d.id)
+		ids = append(ids, d.id)
+	}
+	return ids
+}
+
+// next returns the earliest deadline, if there is one.
+func (s *expiryScheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return time.Time{}, false
+	}
+	return s.queue[0].at, true
+}
+
+// poke wakes the cleanup routine without blocking.
+func (s *expiryScheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// idleWait is how long the cleanup routine sleeps with nothing scheduled.
+const idleWait = time.Hour
+
+// startCleanupRoutine removes shares and rooms as their deadlines pass.
+func startCleanupRoutine() {
+	go func() {
+		for {
+			cleanupExpiredEntries()
+			wait := idleWait
+			if at, ok := expiries.next(); ok {
+				wait = time.Until(at)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-expiries.wake:
+			}
+			timer.Stop()
+		}
+	}()
+}
+
+// cleanupExpiredEntries removes everything whose deadline has passed.
+func cleanupExpiredEntries() {
+	now := time.Now()
+	ids := expiries.due(now)
+	if len(ids) == 0 {
+		return
+	}
+
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+	cleanupRuns.inc()
+	for _, id := range ids {
+		if entry, ok := shares[id]; ok {
+			// Moved later since it was scheduled
+			if entry.ExpiresAt.After(now) {
+				expiries.schedule(id, entry.ExpiresAt)
+				continue
+			}
+			removeShare(entry)
+			cleanupExpired.inc(string(entry.Kind))
+			auditExpired(string(entry.Kind), entry.ID, "ttl")
+			slog.Info("Cleaned up expired share", "kind", entry.Kind, "id", entry.ID)
+		} else if room := rooms[id]; room != nil {
+			closeRoom(room)
+			cleanupExpired.inc("room")
+			auditExpired("room", id, "ttl")
+		}
+	}
+	slog.Info("Cleanup completed", "removed", len(ids), "duration", time.Since(now))
+}
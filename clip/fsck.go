@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runFsck reconciles the metadata store with uploads/: it reports shares
+// whose files are missing or the wrong size, and files no share owns. With
+// -repair, which needs the server stopped, it forgets those shares and
+// deletes those files. Without it, files a running server may still be
+// writing aren't reported.
+func runFsck(args []string) int {
+	fset := commandFlags("fsck", "[-repair]")
+	repair := fset.Bool("repair", false, "forget shares with missing files and delete files no share owns; needs the server stopped")
+	fset.Parse(args)
+
+	var all map[string]Share
+	if *repair {
+		if !openStore() {
+			return 2
+		}
+		defer store.close()
+		all = shares
+	} else {
+		var ok bool
+		if all, ok = readShares(); !ok {
+			return 2
+		}
+	}
+
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	problems := 0
+	owned := make(map[string]bool)
+	for _, id := range ids {
+		share := all[id]
+		ok := checkShare(share)
+		if ok || !*repair {
+			for _, b := range shareBlobs(share) {
+				owned[b.Path] = true
+			}
+		}
+		if ok {
+			continue
+		}
+		problems++
+		if *repair {
+			if err := store.delete(id); err != nil {
+				fmt.Fprintln(os.Stderr, "fsck:", err)
+				return 2
+			}
+			fmt.Printf("%s %s: forgotten\n", share.Kind, id)
+		}
+	}
+
+	var orphans []string
+	err := filepath.WalkDir("uploads", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Uploads in progress, or left by a crash and cleared at startup
+		if d.IsDir() && strings.HasPrefix(d.Name(), "tmp_") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || owned[path] {
+			return nil
+		}
+		// Without -repair the server may be running, and mid-way through
+		// writing these; with it they are leftovers
+		if !*repair && inFlight(d) {
+			return nil
+		}
+		orphans = append(orphans, path)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "fsck: reading uploads:", err)
+		return 2
+	}
+	for _, path := range orphans {
+		problems++
+		if !*repair {
+			fmt.Printf("orphan %s\n", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Fprintln(os.Stderr, "fsck:", err)
+			continue
+		}
+		fmt.Printf("orphan %s: deleted\n", path)
+	}
+	if *repair {
+		removeEmptyDirs("uploads")
+	}
+
+	fmt.Printf("%d shares checked, %d problems\n", len(all), problems)
+	if problems > 0 && !*repair {
+		return 1
+	}
+	return 0
+}
+
+// inFlightAge is how long a running server may take between writing a
+// share's files and recording the share.
+const inFlightAge = time.Minute
+
+// inFlight reports whether a file no share owns may be one a running server
+// is still working with: a readiness probe, a photo being stripped of its
+// metadata, or the files of a share not yet recorded.
+func inFlight(d fs.DirEntry) bool {
+	if strings.HasPrefix(d.Name(), ".readyz-") || strings.HasSuffix(d.Name(), ".strip") {
+		return true
+	}
+	info, err := d.Info()
+	return err != nil || time.Since(info.ModTime()) < inFlightAge
+}
+
+// checkShare reports whether all of a share's files are in place, printing
+// what isn't.
+func checkShare(share Share) bool {
+	if !validKey(share.Key) {
+		fmt.Printf("%s %s: no valid storage key %q\n", share.Kind, share.ID, share.Key)
+		return false
+	}
+	ok := true
+	for _, b := range shareBlobs(share) {
+		info, err := os.Stat(b.Path)
+		switch {
+		case err != nil:
+			fmt.Printf("%s %s: missing %s\n", share.Kind, share.ID, b.Path)
+			ok = false
+		case b.Size >= 0 && info.Size() != b.Size:
+			fmt.Printf("%s %s: %s is %d bytes, expected %d\n", share.Kind, share.ID, b.Path, info.Size(), b.Size)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// removeEmptyDirs deletes the directories under root left empty, deepest
+// first.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// Fails, as it should, unless the directory is empty
+		os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// indexLoaded is set once startup has finished preparing the share index.
+	indexLoaded atomic.Bool
+	// draining is set when the server has been asked to shut down.
+	draining atomic.Bool
+	// drainDelay is how long /readyz reports 503 before the listener closes.
+	drainDelay time.Duration
+)
+
+// healthHandler is the liveness probe: it answers as long as the process
+// is serving, and reports the storage state for operators.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := struct {
+		Status  string        `json:"status"`
+		Storage storageStatus `json:"storage"`
+	}{
+		Status:  "ok",
+		Storage: currentStorageStatus(),
+	}
+	if report.Storage.Low {
+		report.Status = "low_space"
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// readyHandler is the readiness probe. It fails while draining, before the
+// index is loaded, when uploads/ can't be written or when disk space is
+// below the threshold.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"draining": "ok",
+		"index":    "ok",
+		"storage":  "ok",
+		"disk":     "ok",
+	}
+	if draining.Load() {
+		checks["draining"] = "shutting down"
+	}
+	if !indexLoaded.Load() {
+		checks["index"] = "not loaded"
+	}
+	if err := checkWritable("uploads"); err != nil {
+		checks["storage"] = err.Error()
+	}
+	if err := checkCapacity(0); err != nil {
+		checks["disk"] = err.Error()
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			status, code = "not ready", http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+// checkWritable verifies that a file can be created in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
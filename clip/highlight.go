@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A small table-driven highlighter. Each language is described by its
+// keywords, comment and string syntax; the scanner is shared.
+
+type language struct {
+	Name  string // stored on entries and used in the form
+	Label string
+
+	keywords     map[string]bool
+	builtins     map[string]bool // types, constants and well-known functions
+	lineComments []string
+	blockComment [2]string
+	quotes       string // characters that open a string
+	tripleQuotes bool   // Python-style """ and ''' strings
+	ignoreCase   bool   // keywords match case-insensitively (SQL)
+	keys         bool   // a word or string followed by ':' is a key (JSON, YAML, CSS)
+	variables    bool   // $name and ${name} are variables (shell)
+	markup       bool   // <tags attr="value"> (HTML, XML)
+}
+
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var languages = []*language{
+	{Name: "text", Label: "Plain text"},
+	{
+		Name:  "go",
+		Label: "Go",
+		keywords: words(`break case chan const continue default defer else fallthrough for func go goto if
+			import interface map package range return select struct switch type var`),
+		builtins: words(`append cap clear close complex copy delete imag len make max min new panic print println
+			real recover any bool byte comparable complex64 complex128 error float32 float64 int int8 int16
+			int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr true false iota nil`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	{
+		Name:  "python",
+		Label: "Python",
+		keywords: words(`and as assert async await break class continue def del elif else except finally for
+			from global if import in is lambda nonlocal not or pass raise return try while with yield match case`),
+		builtins: words(`True False None self print len range str int float list dict set tuple bool open
+			isinstance super enumerate zip map filter sorted type object Exception`),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		tripleQuotes: true,
+	},
+	{
+		Name:  "javascript",
+		Label: "JavaScript",
+		keywords: words(`async await break case catch class const continue debugger default delete do else
+			export extends finally for from function if import in instanceof let new of return static super
+			switch this throw try typeof var void while with yield`),
+		builtins: words(`true false null undefined NaN Infinity console window document Array Object String
+			Number Boolean Promise Map Set JSON Math Date Error RegExp Symbol`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	{
+		Name:  "typescript",
+		Label: "TypeScript",
+		keywords: words(`abstract as async await break case catch class const continue declare default delete
+			do else enum export extends finally for from function if implements import in instanceof interface
+			keyof let namespace new of private protected public readonly return static super switch this throw
+			try type typeof var void while yield`),
+		builtins: words(`true false null undefined any unknown never string number boolean object void
+			console Array Object String Number Boolean Promise Map Set Record Partial JSON Math Date Error`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	{
+		Name:     "json",
+		Label:    "JSON",
+		builtins: words(`true false null`),
+		quotes:   `"`,
+		keys:     true,
+	},
+	{
+		Name:  "shell",
+		Label: "Shell",
+		keywords: words(`if then else elif fi case esac for select while until do done in function return
+			local export readonly declare set unset shift exit break continue`),
+		builtins: words(`echo printf cd pwd ls cat grep sed awk find xargs test read source eval exec
+			kubectl docker git curl sudo true false`),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		variables:    true,
+	},
+	{
+		Name:  "c",
+		Label: "C",
+		keywords: words(`auto break case const continue default do else enum extern for goto if inline
+			register restrict return sizeof static struct switch typedef union volatile while`),
+		builtins: words(`char double float int long short signed unsigned void bool size_t NULL true false
+			printf malloc free`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	},
+	{
+		Name:  "cpp",
+		Label: "C++",
+		keywords: words(`auto break case catch class const constexpr continue default delete do else enum
+			explicit extern for friend goto if inline namespace new noexcept operator private protected public
+			return sizeof static struct switch template this throw try typedef typename union using virtual
+			volatile while`),
+		builtins: words(`bool char double float int long short signed unsigned void size_t nullptr true
+			false std string vector map cout endl`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	},
+	{
+		Name:  "java",
+		Label: "Java",
+		keywords: words(`abstract assert break case catch class const continue default do else enum extends
+			final finally for if implements import instanceof interface native new package private protected
+			public return static super switch synchronized this throw throws try var void volatile while record`),
+		builtins: words(`boolean byte char double float int long short String Object Integer List Map
+			true false null System`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	},
+	{
+		Name:  "rust",
+		Label: "Rust",
+		keywords: words(`as async await break const continue crate dyn else enum extern fn for if impl in let
+			loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while`),
+		builtins: words(`bool char f32 f64 i8 i16 i32 i64 i128 isize str u8 u16 u32 u64 u128 usize String Vec
+			Option Some None Result Ok Err Box true false println format vec`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"`,
+	},
+	{
+		Name:  "sql",
+		Label: "SQL",
+		keywords: words(`select from where and or not insert into values update set delete create table drop
+			alter index view join inner left right outer full on as group by order having limit offset union all
+			distinct case when then else end is null like in exists between primary key foreign references
+			default begin commit rollback with returning`),
+		builtins: words(`count sum avg min max coalesce now int integer bigint text varchar char boolean date
+			timestamp serial true false`),
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `'"`,
+		ignoreCase:   true,
+	},
+	{
+		Name:         "yaml",
+		Label:        "YAML",
+		builtins:     words(`true false null yes no on off ~`),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		keys:         true,
+	},
+	{
+		Name:         "html",
+		Label:        "HTML / XML",
+		blockComment: [2]string{"<!--", "-->"},
+		markup:       true,
+	},
+	{
+		Name:         "css",
+		Label:        "CSS",
+		builtins:     words(`important inherit initial none auto block flex grid inline`),
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		keys:         true,
+	},
+	// Markdown shares are rendered rather than highlighted, so only ever
+	// chosen explicitly; detectLanguage has no hints for it.
+	{Name: "markdown", Label: "Markdown"},
+}
+
+// lookupLanguage returns the language with the given name, or nil.
+func lookupLanguage(name string) *language {
+	for _, l := range languages {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// languageHints are scored by detectLanguage; the best total wins.
+var languageHints = []struct {
+	lang   string
+	re     *regexp.Regexp
+	weight int
+}{
+	{"go", regexp.MustCompile(`(?m)^package \w+\s*$`), 5},
+	{"go", regexp.MustCompile(`(?m)^func (\(\w+ \*?\w+\) )?\w+\(`), 4},
+	{"go", regexp.MustCompile(`:= |\bfmt\.|\bif err != nil\b`), 3},
+	{"python", regexp.MustCompile(`(?m)^\s*def \w+\(.*\):\s*$`), 5},
+	{"python", regexp.MustCompile(`(?m)^\s*(from [\w.]+ )?import [\w.]+`), 2},
+	{"python", regexp.MustCompile(`(?m)^\s*(class \w+.*|if .*|elif .*|else|for .* in .*|with .*):\s*$`), 2},
+	{"python", regexp.MustCompile(`\bself\.|\bprint\(|__name__`), 2},
+	{"javascript", regexp.MustCompile(`\b(const|let) \w+ = |=> |\bfunction\s*\w*\(`), 3},
+	{"javascript", regexp.MustCompile(`\bconsole\.log\(|\bdocument\.|\brequire\(`), 3},
+	{"typescript", regexp.MustCompile(`\binterface \w+ \{|: (string|number|boolean)\b|\bimport .* from '`), 4},
+	{"shell", regexp.MustCompile(`^#!.*\b(ba|z)?sh\b`), 10},
+	{"shell", regexp.MustCompile(`(?m)^\s*(sudo |apt(-get)? |kubectl |docker |git |curl |export \w+=|echo )`), 3},
+	{"shell", regexp.MustCompile(`\$\{?\w+\}?|\bfi\b|\bdone\b`), 1},
+	{"c", regexp.MustCompile(`(?m)^#include\s*<\w+\.h>`), 6},
+	{"c", regexp.MustCompile(`\bint main\s*\(|\bprintf\(|\bmalloc\(`), 3},
+	{"cpp", regexp.MustCompile(`(?m)^#include\s*<\w+>$|\bstd::|\bnamespace \w+|\btemplate\s*<`), 6},
+	{"java", regexp.MustCompile(`\bpublic (static |final )*(class|void|interface)\b|System\.out\.print`), 6},
+	{"rust", regexp.MustCompile(`\bfn \w+\(|\blet mut\b|\bimpl\b|println!\(|::new\(`), 4},
+	{"sql", regexp.MustCompile(`(?i)\b(select\s.+\sfrom|insert\s+into|create\s+table|update\s+\w+\s+set)\b`), 6},
+	{"yaml", regexp.MustCompile(`(?m)^\s*[\w.-]+:( .*)?$`), 1},
+	{"yaml", regexp.MustCompile(`(?m)^---\s*$|^\s*- \w+:`), 2},
+	{"yaml", regexp.MustCompile(`(?m)^(apiVersion|kind|metadata):`), 6},
+	{"html", regexp.MustCompile(`(?i)<!doctype html|<html|<div|<\?xml|</\w+>`), 5},
+	{"css", regexp.MustCompile(`(?m)^\s*[.#]?[\w-]+(\s*[,>]\s*[.#]?[\w-]+)*\s*\{\s*$`), 3},
+	{"css", regexp.MustCompile(`(?m)^\s*[\w-]+:\s*[^;]+;\s*$`), 2},
+}
+
+// detectLanguage guesses the language of content, falling back to plain
+// text when nothing scores convincingly.
+func detectLanguage(content string) string {
+	sample := content
+	if len(sample) > 32<<10 {
+		sample = sample[:32<<10]
+	}
+
+	trimmed := strings.TrimSpace(content)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+
+	// Each hint counts at most a few times, so long prose with a handful
+	// of "Key: value" lines doesn't turn into YAML
+	scores := make(map[string]int)
+	for _, hint := range languageHints {
+		if n := len(hint.re.FindAllStringIndex(sample, 4)); n > 0 {
+			scores[hint.lang] += hint.weight * n
+		}
+	}
+	// TypeScript is JavaScript with types
+	if scores["typescript"] > 0 {
+		scores["typescript"] += scores["javascript"]
+	}
+
+	best, bestScore := "text", 5
+	for _, l := range languages {
+		if scores[l.Name] > bestScore {
+			best, bestScore = l.Name, scores[l.Name]
+		}
+	}
+	return best
+}
+
+// codeLine is one highlighted line of a text share.
+type codeLine struct {
+	N    int
+	HTML template.HTML
+}
+
+// token is a run of source text with a highlight class ("" for plain).
+type token struct {
+	class string
+	text  string
+}
+
+// highlight renders content as escaped, classed HTML, one entry per line.
+func highlight(content, langName string) []codeLine {
+	lang := lookupLanguage(langName)
+	if lang == nil {
+		lang = languages[0]
+	}
+	var tokens []token
+	if lang.markup {
+		tokens = scanMarkup(content, lang)
+	} else {
+		tokens = scanCode(content, lang)
+	}
+
+	var lines []codeLine
+	var b strings.Builder
+	flush := func() {
+		lines = append(lines, codeLine{N: len(lines) + 1, HTML: template.HTML(b.String())})
+		b.Reset()
+	}
+	for _, t := range tokens {
+		// Split tokens that span lines so every line stands alone
+		for i, part := range strings.Split(t.text, "\n") {
+			if i > 0 {
+				flush()
+			}
+			if part == "" {
+				continue
+			}
+			if t.class == "" {
+				b.WriteString(html.EscapeString(part))
+			} else {
+				b.WriteString(`<span class="tok-` + t.class + `">` + html.EscapeString(part) + `</span>`)
+			}
+		}
+	}
+	flush()
+
+	// Drop the empty line produced by a trailing newline
+	if len(lines) > 1 && lines[len(lines)-1].HTML == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// scanCode tokenizes content for a C-like, script or data language.
+func scanCode(src string, lang *language) []token {
+	var tokens []token
+	plainStart := 0
+	emit := func(start, end int, class string) {
+		if plainStart < start {
+			tokens = append(tokens, token{"", src[plainStart:start]})
+		}
+		tokens = append(tokens, token{class, src[start:end]})
+		plainStart = end
+	}
+
+	i := 0
+	for i < len(src) {
+		rest := src[i:]
+
+		if lang.blockComment[0] != "" && strings.HasPrefix(rest, lang.blockComment[0]) {
+			end := strings.Index(rest[len(lang.blockComment[0]):], lang.blockComment[1])
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(lang.blockComment[0]) + len(lang.blockComment[1])
+			}
+			emit(i, i+end, "com")
+			i += end
+			continue
+		}
+		if lineComment(rest, lang, i == 0 || src[i-1] == '\n' || src[i-1] == ' ' || src[i-1] == '\t') {
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			emit(i, i+end, "com")
+			i += end
+			continue
+		}
+
+		c := src[i]
+		if lang.quotes != "" && strings.IndexByte(lang.quotes, c) >= 0 {
+			end := scanString(rest, lang)
+			class := "str"
+			if lang.keys && followedByColon(src[i+end:]) {
+				class = "key"
+			}
+			emit(i, i+end, class)
+			i += end
+			continue
+		}
+		if lang.variables && c == '$' && i+1 < len(src) {
+			end := 1
+			if src[i+1] == '{' {
+				if close := strings.IndexByte(rest, '}'); close > 0 {
+					end = close + 1
+				}
+			} else {
+				for end < len(rest) && (isWordRune(rune(rest[end])) || (end == 1 && strings.IndexByte("@#?$!*-", rest[end]) >= 0)) {
+					end++
+				}
+			}
+			if end > 1 {
+				emit(i, i+end, "var")
+				i += end
+				continue
+			}
+		}
+		if c >= '0' && c <= '9' && (i == 0 || !isWordRune(rune(src[i-1]))) {
+			end := 1
+			for end < len(rest) && (isWordRune(rune(rest[end])) || rest[end] == '.' && end+1 < len(rest) && rest[end+1] >= '0' && rest[end+1] <= '9') {
+				end++
+			}
+			emit(i, i+end, "num")
+			i += end
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+		if isWordRune(r) {
+			end := size
+			for end < len(rest) {
+				r, n := utf8.DecodeRuneInString(rest[end:])
+				if !isWordRune(r) && !(lang.keys && r == '-' && lang.Name != "json") {
+					break
+				}
+				end += n
+			}
+			word := rest[:end]
+			lookup := word
+			if lang.ignoreCase {
+				lookup = strings.ToLower(word)
+			}
+			switch {
+			case lang.keywords[lookup]:
+				emit(i, i+end, "kw")
+			case lang.builtins[lookup]:
+				emit(i, i+end, "bi")
+			case lang.keys && followedByColon(rest[end:]):
+				emit(i, i+end, "key")
+			case strings.HasPrefix(strings.TrimLeft(rest[end:], " "), "("):
+				emit(i, i+end, "fn")
+			}
+			i += end
+			continue
+		}
+		i += size
+	}
+	if plainStart < len(src) {
+		tokens = append(tokens, token{"", src[plainStart:]})
+	}
+	return tokens
+}
+
+// lineComment reports whether rest starts a line comment. '#' only counts
+// at a word boundary, so shell "$#" and CSS colours aren't comments.
+func lineComment(rest string, lang *language, atBoundary bool) bool {
+	for _, prefix := range lang.lineComments {
+		if strings.HasPrefix(rest, prefix) && (prefix != "#" || atBoundary) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanString returns the length of the string literal at the start of s.
+func scanString(s string, lang *language) int {
+	quote := s[0]
+	if lang.tripleQuotes && len(s) >= 3 && s[1] == quote && s[2] == quote {
+		delim := s[:3]
+		if end := strings.Index(s[3:], delim); end >= 0 {
+			return end + 6
+		}
+		return len(s)
+	}
+	multiline := quote == '`'
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1
+		case '\n':
+			if !multiline {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+func followedByColon(s string) bool {
+	s = strings.TrimLeft(s, " \t")
+	return strings.HasPrefix(s, ":") && !strings.HasPrefix(s, "::")
+}
+
+// scanMarkup tokenizes HTML and XML: comments, tags, attribute names and
+// attribute values.
+func scanMarkup(src string, lang *language) []token {
+	var tokens []token
+	plainStart := 0
+	emit := func(start, end int, class string) {
+		if plainStart < start {
+			tokens = append(tokens, token{"", src[plainStart:start]})
+		}
+		tokens = append(tokens, token{class, src[start:end]})
+		plainStart = end
+	}
+
+	i := 0
+	for i < len(src) {
+		rest := src[i:]
+		if strings.HasPrefix(rest, lang.blockComment[0]) {
+			end := strings.Index(rest, lang.blockComment[1])
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(lang.blockComment[1])
+			}
+			emit(i, i+end, "com")
+			i += end
+			continue
+		}
+		if rest[0] != '<' || len(rest) < 2 || !(rest[1] == '/' || rest[1] == '!' || rest[1] == '?' || unicode.IsLetter(rune(rest[1]))) {
+			i++
+			continue
+		}
+
+		// Tag name, including the leading "</", "<!" or "<?"
+		end := 2
+		for end < len(rest) && !strings.ContainsRune(" \t\n>/", rune(rest[end])) {
+			end++
+		}
+		emit(i, i+end, "tag")
+		i += end
+
+		// Attributes up to the closing '>'
+		for i < len(src) && src[i] != '>' {
+			switch c := src[i]; {
+			case c == '"' || c == '\'':
+				close := strings.IndexByte(src[i+1:], c)
+				stop := len(src)
+				if close >= 0 {
+					stop = i + close + 2
+				}
+				emit(i, stop, "str")
+				i = stop
+			case isWordRune(rune(c)):
+				stop := i
+				for stop < len(src) && (isWordRune(rune(src[stop])) || src[stop] == '-' || src[stop] == ':') {
+					stop++
+				}
+				emit(i, stop, "attr")
+				i = stop
+			default:
+				i++
+			}
+		}
+		if i < len(src) {
+			start := i
+			if src[i-1] == '/' && plainStart < i {
+				start--
+			}
+			emit(start, i+1, "tag")
+			i++
+		}
+	}
+	if plainStart < len(src) {
+		tokens = append(tokens, token{"", src[plainStart:]})
+	}
+	return tokens
+}
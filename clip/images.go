@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Image uploads get a thumbnail, made here with the standard library's
+// JPEG, PNG and GIF decoders. There is no WebP decoder in the standard
+// library, so WebP images are shared without one.
+//
+// JPEGs can also have their metadata stripped before they are published:
+// EXIF (which carries GPS position, camera and timestamps), XMP, IPTC and
+// comments are dropped without re-encoding the image. Only the orientation
+// survives, in a minimal EXIF block, so photos still display upright.
+
+const (
+	thumbnailSize = 480 // longest side, in pixels
+	// maxThumbnailPixels bounds what we're willing to decode; a small
+	// file can declare an enormous image.
+	maxThumbnailPixels = 50_000_000
+)
+
+// stripMetadata is set by -strip-metadata to strip every JPEG, whatever
+// the uploader chose.
+var stripMetadata bool
+
+var errNotJPEG = errors.New("not a JPEG")
+
+func isJPEG(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 3)
+	_, err = io.ReadFull(f, head)
+	return err == nil && bytes.Equal(head, []byte{0xff, 0xd8, 0xff})
+}
+
+// stripJPEGMetadata rewrites the JPEG at path without its metadata
+// segments, adjusting storageUsed for the change in size.
+func stripJPEGMetadata(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".strip"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(dst)
+	err = copyJPEGWithoutMetadata(w, bufio.NewReader(src))
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	var newInfo os.FileInfo
+	if err == nil {
+		newInfo, err = os.Stat(tmpPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	storageUsed.Add(newInfo.Size() - info.Size())
+	return nil
+}
+
+// copyJPEGWithoutMetadata copies a JPEG's segments and image data, leaving
+// out APP1 (EXIF, XMP), APP13 (IPTC), comments and the APP2 index of any
+// MPF images. It stops at the end of the image: phones append depth maps
+// and other MPF images after it, each with EXIF of its own.
+func copyJPEGWithoutMetadata(w io.Writer, r *bufio.Reader) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return errNotJPEG
+	}
+	w.Write(soi)
+
+	orientation := 0
+	wroteOrientation := false
+	var marker byte
+	next := false // marker was read at the end of a scan
+	for {
+		if !next {
+			var err error
+			if marker, err = readMarker(r); err != nil {
+				return err
+			}
+		}
+		next = false
+		// Markers without a length
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			w.Write([]byte{0xff, marker})
+			continue
+		}
+		if marker == 0xd9 {
+			w.Write([]byte{0xff, marker})
+			return nil
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return errNotJPEG
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		switch {
+		case marker == 0xe1:
+			if o := exifOrientation(data); o > 0 {
+				orientation = o
+			}
+			continue
+		case marker == 0xe2 && bytes.HasPrefix(data, []byte("MPF\x00")):
+			continue
+		case marker == 0xed, marker == 0xfe:
+			continue
+		}
+		// The orientation goes where EXIF normally would, after JFIF
+		if marker != 0xe0 && orientation > 1 && !wroteOrientation {
+			w.Write(orientationSegment(orientation))
+			wroteOrientation = true
+		}
+		w.Write([]byte{0xff, marker})
+		w.Write(length[:])
+		w.Write(data)
+
+		if marker == 0xda {
+			// Start of scan: the image data follows, up to the next marker
+			var err error
+			marker, err = copyScan(w, r)
+			if err == io.EOF {
+				// A file cut short after its image data is kept as it is
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			next = true
+		}
+	}
+}
+
+// copyScan copies entropy-coded image data up to the marker that ends it,
+// and returns that marker. Stuffed 0xff bytes and restart markers are part
+// of the data.
+func copyScan(w io.Writer, r *bufio.Reader) (byte, error) {
+	for {
+		chunk, err := r.ReadSlice(0xff)
+		if err == bufio.ErrBufferFull {
+			w.Write(chunk)
+			continue
+		}
+		if err != nil {
+			w.Write(chunk)
+			return 0, err
+		}
+		w.Write(chunk[:len(chunk)-1])
+		b := byte(0xff)
+		for b == 0xff {
+			if b, err = r.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+		if b == 0x00 || b >= 0xd0 && b <= 0xd7 {
+			w.Write([]byte{0xff, b})
+			continue
+		}
+		return b, nil
+	}
+}
+
+func readMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, errNotJPEG
+	}
+	// Any number of 0xff fill bytes may come before the marker
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// exifOrientation returns the orientation tag from an APP1 segment's EXIF
+// data, or 0 if there isn't one.
+func exifOrientation(data []byte) int {
+	tiff, ok := bytes.CutPrefix(data, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// Orientation is a SHORT, stored in the entry itself
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 0
+}
+
+// orientationSegment builds an APP1 segment holding nothing but an EXIF
+// orientation tag.
+func orientationSegment(orientation int) []byte {
+	seg := []byte{0xff, 0xe1, 0, 0}
+	seg = append(seg, "Exif\x00\x00"...)
+	seg = append(seg, "MM\x00\x2a\x00\x00\x00\x08"...) // big-endian TIFF, IFD at 8
+	seg = append(seg, 0, 1)                            // one entry
+	seg = append(seg, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0)
+	seg = append(seg, 0, 0, 0, 0) // no next IFD
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)-2))
+	return seg
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG file.
+func jpegOrientation(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[1] != 0xd8 {
+		return 0
+	}
+	for {
+		marker, err := readMarker(r)
+		if err != nil || marker == 0xda {
+			return 0
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return 0
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return 0
+		}
+		if marker != 0xe1 {
+			if _, err := r.Discard(n); err != nil {
+				return 0
+			}
+			continue
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 0
+		}
+		if o := exifOrientation(data); o > 0 {
+			return o
+		}
+	}
+}
+
+// makeThumbnail writes a thumbnail of the image at src beside the file
+// stored under key, and returns its path within uploads/, or "" if src
+// isn't an image we can decode.
+func makeThumbnail(key, src string) string {
+	f, err := os.Open(src)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil || cfg.Width*cfg.Height > maxThumbnailPixels {
+		return ""
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		slog.Warn("Failed to decode image", "path", src, "err", err)
+		return ""
+	}
+
+	thumb := scaleDown(img, thumbnailSize)
+	if format == "jpeg" {
+		thumb = orient(thumb, jpegOrientation(src))
+	}
+
+	var buf bytes.Buffer
+	name := blobName(key) + ".thumb.jpg"
+	if thumb.Opaque() {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		name = blobName(key) + ".thumb.png"
+		err = png.Encode(&buf, thumb)
+	}
+	if err == nil {
+		err = writeUpload(filepath.Join("uploads", name), buf.Bytes())
+	}
+	if err != nil {
+		slog.Warn("Failed to store thumbnail", "path", src, "err", err)
+		return ""
+	}
+	return name
+}
+
+// scaleDown shrinks img to fit within size×size. Each output pixel averages
+// a grid of samples from the area it covers, which is plenty for a
+// thumbnail and far cheaper than reading every source pixel.
+func scaleDown(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	const samples = 4
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint32
+			for sy := 0; sy < samples; sy++ {
+				py := y0 + (y1-y0)*sy/samples
+				for sx := 0; sx < samples; sx++ {
+					px := x0 + (x1-x0)*sx/samples
+					cr, cg, cb, ca := img.At(px, py).RGBA()
+					r, g, bl, a, n = r+cr, g+cg, bl+cb, a+ca, n+1
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return out
+}
+
+// orient applies an EXIF orientation, which JPEG decoding ignores.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 swap width and height
+	ow, oh := w, h
+	if orientation >= 5 {
+		ow, oh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, ow, oh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // mirrored, rotated
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise to display
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise to display
+				dx, dy = y, w-1-x
+			}
+			out.SetRGBA(dx, dy, img.RGBAAt(x, y))
+		}
+	}
+	return out
+}
+
+// thumbnailHandler serves a file share's thumbnail.
+func thumbnailHandler(w http.ResponseWriter, r *http.Request, entry Share) {
+	if entry.Thumbnail == "" {
+		http.NotFound(w, r)
+		return
+	}
+	sandboxUserContent(w)
+	w.Header().Set("Cache-Control", "private, max-age=43200")
+	http.ServeFile(w, r, filepath.Join("uploads", entry.Thumbnail))
+}
+
+// removeThumbnail deletes a file share's thumbnail, if it has one.
+func removeThumbnail(entry Share) {
+	if entry.Thumbnail == "" {
+		return
+	}
+	path := filepath.Join("uploads", entry.Thumbnail)
+	if err := removeUpload(path); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove thumbnail", "path", path, "err", err)
+	}
+}
+
+// imagePage shows an image share's thumbnail with a link to the original.
+func imagePage(w http.ResponseWriter, r *http.Request, entry Share, size int64) {
+	countView(entry)
+	render(w, "image.html", struct {
+		ID        string
+		URL       string
+		Filename  string
+		SizeLabel string
+		TimeLeft  string
+		CreatedAt time.Time
+	}{
+		ID:        entry.ID,
+		URL:       r.Host + r.URL.Path,
+		Filename:  entry.Filename,
+		SizeLabel: formatBytes(size),
+		TimeLeft:  formatDuration(time.Until(entry.ExpiresAt)),
+		CreatedAt: entry.CreatedAt,
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testJPEG encodes a small photo-like image. The encoder writes no
+// metadata, so it is what stripping should get back to.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func jpegSegment(marker byte, data string) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+	return append(seg, data...)
+}
+
+// withSegments inserts segments into a JPEG just after its SOI.
+func withSegments(jpg []byte, segments ...[]byte) []byte {
+	out := append([]byte(nil), jpg[:2]...)
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	return append(out, jpg[2:]...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	plain := testJPEG(t)
+	exif := jpegSegment(0xe1, "Exif\x00\x00GPS 51.5007N 0.1246W")
+	// A phone's MPO: the MPF index in the primary image, then a second
+	// image after its end with EXIF of its own
+	mpf := jpegSegment(0xe2, "MPF\x00II*\x00 index of images")
+	icc := jpegSegment(0xe2, "ICC_PROFILE\x00\x01\x01profile")
+	secondary := withSegments(plain, jpegSegment(0xe1, "Exif\x00\x00GPS 48.8584N 2.2945E"))
+
+	for _, tt := range []struct {
+		name     string
+		in, want []byte
+	}{
+		{"plain", plain, plain},
+		{"exif and comment", withSegments(plain, exif, jpegSegment(0xfe, "taken at home")), plain},
+		{"trailing mpf image", append(withSegments(plain, exif, mpf), secondary...), plain},
+		{"trailing garbage", append(append([]byte(nil), plain...), "GPS 51.5007N"...), plain},
+		{"icc profile kept", withSegments(plain, icc, exif), withSegments(plain, icc)},
+		{"orientation kept", withSegments(plain, orientationSegment(6)), withSegments(plain, orientationSegment(6))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "photo")
+			if err := os.WriteFile(path, tt.in, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := stripJPEGMetadata(path); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(got, []byte("GPS")) {
+				t.Error("location survived stripping")
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("stripped to %d bytes, want %d", len(got), len(tt.want))
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+				t.Errorf("stripped photo doesn't decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestCopyScanKeepsStuffedBytes(t *testing.T) {
+	// Stuffed 0xff, fill bytes and a restart marker are image data; the
+	// next real marker ends the scan
+	data := []byte{1, 2, 0xff, 0x00, 3, 0xff, 0xd3, 4, 0xff, 0xff, 0xc4, 9}
+	var out bytes.Buffer
+	marker, err := copyScan(&out, bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marker != 0xc4 {
+		t.Errorf("scan ended at marker %#x, want 0xc4", marker)
+	}
+	if want := []byte{1, 2, 0xff, 0x00, 3, 0xff, 0xd3, 4}; !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("copied % x, want % x", out.Bytes(), want)
+	}
+}
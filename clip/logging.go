@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// auditLog records who created, viewed, downloaded or deleted which
+	// share, and why shares expired. It is kept apart from the access log so
+	// it can be shipped and retained separately.
+	auditLog = slog.Default()
+
+	// trustProxy makes clientIP honour X-Forwarded-For and isHTTPS honour
+	// X-Forwarded-Proto, for deployments behind an ingress.
+	trustProxy bool
+)
+
+// setupLogging installs the default structured logger and opens the audit
+// stream. format is "text" or "json"; an empty auditPath sends audit records
+// to the main log, tagged with stream=audit.
+func setupLogging(format, auditPath string) error {
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, format)))
+
+	if auditPath == "" {
+		auditLog = slog.Default().With("stream", "audit")
+		return nil
+	}
+	f, err := os.OpenFile(auditPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog = slog.New(slog.NewJSONHandler(f, nil)).With("stream", "audit")
+	return nil
+}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	if format == "json" {
+		return slog.NewJSONHandler(w, nil)
+	}
+	return slog.NewTextHandler(w, nil)
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID assigned to r by the access-log middleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns the caller's X-Request-ID when it looks sane, or a
+// fresh random one.
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 64 && !strings.ContainsAny(id, " \t\r\n\"") {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientIP returns the address the request came from. Behind a trusted
+// proxy that is the last X-Forwarded-For entry, the one the proxy added;
+// anything before it came from the client and may be forged.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			last := fwd[len(fwd)-1]
+			if i := strings.LastIndexByte(last, ','); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// accessLog writes one structured line per request.
+func accessLog(route string, r *http.Request, rec *statusRecorder, start time.Time) {
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+		slog.String("request_id", requestID(r)),
+		slog.String("method", r.Method),
+		slog.String("route", route),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", rec.status),
+		slog.Int64("bytes", rec.bytes),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("ip", clientIP(r)),
+	)
+}
+
+// withRequestID tags the request with an ID and echoes it to the client.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := newRequestID(r)
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// audit records an action taken on a share by the client behind r.
+func audit(r *http.Request, action, shareType, id string, attrs ...any) {
+	auditTrails.add(id, auditRecord{
+		Time:    time.Now(),
+		Action:  action,
+		IP:      clientIP(r),
+		Details: formatAttrs(attrs),
+	})
+	attrs = append([]any{
+		"action", action,
+		"type", shareType,
+		"id", id,
+		"ip", clientIP(r),
+		"user_agent", r.UserAgent(),
+		"request_id", requestID(r),
+	}, attrs...)
+	auditLog.Info("share "+action, attrs...)
+}
+
+// auditExpired records a share removed by the cleanup routine.
+func auditExpired(shareType, id, reason string) {
+	auditTrails.add(id, auditRecord{Time: time.Now(), Action: "expired", Details: "reason=" + reason})
+	auditLog.Info("share expired", "action", "expired", "type", shareType, "id", id, "reason", reason)
+}
+
+// auditRecord is an audit entry as the admin dashboard shows it.
+type auditRecord struct {
+	Time    time.Time
+	Action  string
+	IP      string
+	Details string
+}
+
+const (
+	maxAuditTrail  = 50    // records kept per share
+	maxAuditTrails = 10000 // shares whose records are kept
+)
+
+// auditTrail keeps the latest audit records of each share in memory, for
+// the admin dashboard, which can't count on reading back the audit stream.
+// Trails outlive their shares, so a deleted share's history can still be
+// looked up until newer ones push it out.
+type auditTrail struct {
+	mu    sync.Mutex
+	byID  map[string][]auditRecord
+	order []string // IDs, oldest trail first
+}
+
+var auditTrails = &auditTrail{byID: make(map[string][]auditRecord)}
+
+func (t *auditTrail) add(id string, rec auditRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trail, ok := t.byID[id]
+	if !ok {
+		if len(t.order) >= maxAuditTrails {
+			delete(t.byID, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.order = append(t.order, id)
+	}
+	if len(trail) >= maxAuditTrail {
+		trail = trail[1:]
+	}
+	t.byID[id] = append(trail, rec)
+}
+
+// get returns a copy of id's records, oldest first.
+func (t *auditTrail) get(id string) []auditRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]auditRecord(nil), t.byID[id]...)
+}
+
+// formatAttrs renders slog-style key-value pairs as "key=value" text.
+func formatAttrs(attrs []any) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		value := attrs[i+1]
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&b, "%v=%v", attrs[i], value)
+	}
+	return b.String()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(old bool) { trustProxy = old }(trustProxy)
+	for _, tt := range []struct {
+		trust bool
+		fwd   []string
+		want  string
+	}{
+		{false, nil, "10.0.0.9"},
+		{false, []string{"203.0.113.7"}, "10.0.0.9"},
+		{true, nil, "10.0.0.9"},
+		{true, []string{"203.0.113.7"}, "203.0.113.7"},
+		// The client sent the first entry; the proxy appended the last
+		{true, []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{true, []string{"1.2.3.4", "203.0.113.7"}, "203.0.113.7"},
+		{true, []string{"1.2.3.4,"}, "10.0.0.9"},
+	} {
+		trustProxy = tt.trust
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.9:5123"
+		for _, v := range tt.fwd {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("trust %v, X-Forwarded-For %q: got %s, want %s", tt.trust, tt.fwd, got, tt.want)
+		}
+	}
+}
@@ -1,39 +1,42 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"math/big"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-type ClipboardEntry struct {
-	ID        string
-	Content   string
-	CreatedAt time.Time
-}
-
-type FileEntry struct {
-	ID        string
-	Filename  string
-	CreatedAt time.Time
-}
-
 type PageData struct {
-	ClipboardEntries []ClipboardEntry
-	FileEntries      []FileEntry
+	ClipboardEntries []Share
+	FileEntries      []Share
+	BundleEntries    []Share
 	Message          string
+	CSRFToken        string
+	Languages        []*language
 }
 
-var clipboardEntries = make(map[string]ClipboardEntry)
-var fileEntries = make(map[string]FileEntry)
+// entriesMu guards shares and rooms, which are shared between handlers and
+// the cleanup routine.
+var entriesMu sync.Mutex
 
 // Word lists for generating memorable URLs
 var adjectives = []string{
@@ -71,569 +74,143 @@ func generateReadableID() string {
 	return fmt.Sprintf("%s-%s", adj, noun)
 }
 
-func startCleanupRoutine() {
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour) // Check every hour
-		defer ticker.Stop()
-		
-		for {
-			select {
-			case <-ticker.C:
-				cleanupExpiredEntries()
-			}
-		}
-	}()
+// handle registers a handler on the default mux behind the common
+// middleware: security headers, CSRF checks, metrics and access logging.
+func handle(pattern string, handler http.HandlerFunc) {
+	http.Handle(pattern, instrument(pattern, secureHeaders(csrfProtect(handler))))
 }
 
-func cleanupExpiredEntries() {
-	now := time.Now()
-	cutoff := now.Add(-12 * time.Hour) // 12 hours ago
-	
-	// Clean clipboard entries
-	for id, entry := range clipboardEntries {
-		if entry.CreatedAt.Before(cutoff) {
-			// Remove from memory
-			delete(clipboardEntries, id)
-			
-			// Remove file
-			filename := fmt.Sprintf("clipboard_%s.txt", id)
-			filepath := filepath.Join("uploads", filename)
-			if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
-				log.Printf("Failed to remove expired clipboard file %s: %v", filepath, err)
-			}
-			
-			log.Printf("Cleaned up expired clipboard entry: %s", id)
-		}
+func main() {
+	flag.Var(byteSize{&maxStorageBytes}, "max-storage", "maximum total size of stored shares, e.g. 20G (0 = unlimited)")
+	flag.Var(byteSize{&minFreeBytes}, "min-free", "free disk space to keep available, e.g. 512M")
+	flag.DurationVar(&drainDelay, "drain-delay", 5*time.Second, "how long to report not-ready before shutting down")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	auditPath := flag.String("audit-log", "", "append audit records to this file instead of the main log")
+	flag.BoolVar(&trustProxy, "trust-proxy", false, "take client IPs and HTTPS from the proxy's X-Forwarded-For and X-Forwarded-Proto")
+	flag.BoolVar(&stripMetadata, "strip-metadata", false, "strip EXIF, GPS and other metadata from every uploaded JPEG")
+	flag.BoolVar(&devMode, "dev", false, "reload templates and static assets from disk on every request")
+	flag.StringVar(&metaDir, "meta-dir", metaDir, "directory for the share metadata log and snapshot")
+	flag.StringVar(&themeDir, "theme", "", "directory whose templates/ and static/ files override the built-in ones")
+	flag.StringVar(&adminUser, "admin-user", adminUser, "user name for the /admin dashboard, whose password is read from CLIP_ADMIN_PASSWORD")
+	flag.Usage = usage
+	flag.Parse()
+
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "serve":
+		// The server's flags may also follow the command
+		flag.CommandLine.Parse(flag.Args()[1:])
+	default:
+		os.Exit(runCommand(cmd, flag.Args()[1:]))
 	}
-	
-	// Clean file entries
-	for id, entry := range fileEntries {
-		if entry.CreatedAt.Before(cutoff) {
-			// Remove from memory
-			delete(fileEntries, id)
-			
-			// Find and remove the actual file
-			files, err := os.ReadDir("uploads")
-			if err == nil {
-				for _, file := range files {
-					if strings.HasPrefix(file.Name(), id) {
-						filepath := filepath.Join("uploads", file.Name())
-						if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
-							log.Printf("Failed to remove expired file %s: %v", filepath, err)
-						}
-						break
-					}
-				}
-			}
-			
-			log.Printf("Cleaned up expired file entry: %s (%s)", id, entry.Filename)
-		}
+
+	if err := setupLogging(*logFormat, *auditPath); err != nil {
+		slog.Error("Failed to open audit log", "err", err)
+		os.Exit(1)
 	}
-	
-	log.Printf("Cleanup completed at %s", now.Format("2006-01-02 15:04:05"))
-}
 
-func main() {
 	// Create uploads directory if it doesn't exist
 	if err := os.MkdirAll("uploads", 0755); err != nil {
-		log.Fatal("Failed to create uploads directory:", err)
+		slog.Error("Failed to create uploads directory", "err", err)
+		os.Exit(1)
+	}
+	// Uploads interrupted by a crash never made it out of staging
+	if staged, err := filepath.Glob(filepath.Join("uploads", "tmp_*")); err == nil {
+		for _, dir := range staged {
+			os.RemoveAll(dir)
+		}
+	}
+	if err := initStorageUsage(); err != nil {
+		slog.Warn("Failed to measure uploads directory", "err", err)
+	}
+	var saved map[string]Share
+	var err error
+	if store, saved, err = openMetaStore(metaDir); err != nil {
+		slog.Error("Failed to open the metadata store", "dir", metaDir, "err", err)
+		os.Exit(1)
+	}
+	loadShares(saved)
+	slog.Info("Loaded shares", "count", len(shares))
+	indexLoaded.Store(true)
+
+	// Parse templates up front so a broken theme fails at startup
+	if _, err := getSite(); err != nil {
+		slog.Error("Failed to load templates", "err", err)
+		os.Exit(1)
 	}
 
 	// Start the cleanup routine
 	startCleanupRoutine()
 
 	// Route handlers
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/clipboard", clipboardHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/delete/", deleteHandler)
-	http.HandleFunc("/c/", clipboardViewHandler)
-	http.HandleFunc("/f/", fileViewHandler)
+	handle("/", homeHandler)
+	handle("/clipboard", clipboardHandler)
+	handle("/upload", uploadHandler)
+	handle("/delete/", deleteHandler)
+	handle("/c/", clipboardViewHandler)
+	handle("/rooms", createRoomHandler)
+	handle("/r/", roomHandler)
+	handle("/f/", fileViewHandler)
+	handle("/b/", bundleHandler)
+	handle("/qr/", qrHandler)
+	handle("/created/", createdHandler)
+	handle("/s/", shareRedirectHandler)
+	handle("/static/", staticHandler)
+	handle("/healthz", healthHandler)
+	handle("/readyz", readyHandler)
+	handle("/metrics", metricsHandler)
+	handle("/admin", requireAdmin(adminHandler))
+	handle("/admin/audit/", requireAdmin(adminAuditHandler))
+
+	server := &http.Server{Addr: ":8000"}
+	server.RegisterOnShutdown(closeStreams)
+
+	// On SIGTERM, report not-ready for a while so load balancers stop
+	// sending traffic, then let in-flight requests finish
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		stop()
+		draining.Store(true)
+		slog.Info("Shutting down", "drain_delay", drainDelay)
+		time.Sleep(drainDelay)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Shutdown failed", "err", err)
+		}
+		saveViews()
+	}()
 
 	// Start server
-	fmt.Println("Server starting on http://localhost:8000")
-	fmt.Println("Auto-cleanup: Entries expire after 12 hours")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	slog.Info("Server starting on http://localhost:8000", "expiry", shareTTL.String())
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		slog.Error("Server failed", "err", err)
+		os.Exit(1)
+	}
+	<-stopped
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	// Convert maps to slices for template rendering, sorted by creation time
-	var clipEntries []ClipboardEntry
-	var fileEnts []FileEntry
-	
-	for _, entry := range clipboardEntries {
-		clipEntries = append(clipEntries, entry)
-	}
-	
-	for _, entry := range fileEntries {
-		fileEnts = append(fileEnts, entry)
-	}
-
+	// Each browser sees only the shares it created; /admin lists them all
+	entriesMu.Lock()
 	data := PageData{
-		ClipboardEntries: clipEntries,
-		FileEntries:      fileEnts,
-	}
-
-	tmpl := `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Clip - Private Text & File Sharing</title>
-    <style>
-        * {
-            margin: 0;
-            padding: 0;
-            box-sizing: border-box;
-        }
-        
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
-            background-color: #f5f5f5;
-            min-height: 100vh;
-            display: flex;
-            flex-direction: column;
-        }
-        
-        .header {
-            background-color: #2c3e50;
-            color: white;
-            padding: 1rem;
-            text-align: center;
-            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
-        }
-        
-        .header p {
-            margin-top: 0.5rem;
-            opacity: 0.9;
-            font-size: 0.9rem;
-        }
-        
-        .container {
-            display: flex;
-            flex: 1;
-            gap: 2rem;
-            padding: 2rem;
-            max-width: 1200px;
-            margin: 0 auto;
-            width: 100%;
-        }
-        
-        .panel {
-            flex: 1;
-            background: white;
-            border-radius: 8px;
-            padding: 2rem;
-            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
-            display: flex;
-            flex-direction: column;
-        }
-        
-        .panel h2 {
-            color: #2c3e50;
-            margin-bottom: 1rem;
-            padding-bottom: 0.5rem;
-            border-bottom: 2px solid #3498db;
-        }
-        
-        .clipboard-panel textarea {
-            flex: 1;
-            border: 2px solid #e0e0e0;
-            border-radius: 4px;
-            padding: 1rem;
-            font-family: 'Courier New', monospace;
-            font-size: 14px;
-            resize: none;
-            outline: none;
-            margin-bottom: 1rem;
-            min-height: 200px;
-        }
-        
-        .clipboard-panel textarea:focus {
-            border-color: #3498db;
-        }
-        
-        .upload-panel {
-            display: flex;
-            flex-direction: column;
-        }
-        
-        .upload-area {
-            border: 2px dashed #3498db;
-            border-radius: 8px;
-            padding: 3rem;
-            text-align: center;
-            background-color: #f8f9fa;
-            margin-bottom: 2rem;
-            transition: all 0.3s ease;
-        }
-        
-        .upload-area:hover {
-            background-color: #e8f4f8;
-            border-color: #2980b9;
-        }
-        
-        .upload-area input[type="file"] {
-            display: none;
-        }
-        
-        .upload-btn {
-            background-color: #3498db;
-            color: white;
-            border: none;
-            padding: 1rem 2rem;
-            border-radius: 4px;
-            cursor: pointer;
-            font-size: 16px;
-            transition: background-color 0.3s ease;
-        }
-        
-        .upload-btn:hover {
-            background-color: #2980b9;
-        }
-        
-        .btn {
-            background-color: #27ae60;
-            color: white;
-            border: none;
-            padding: 0.75rem 1.5rem;
-            border-radius: 4px;
-            cursor: pointer;
-            font-size: 14px;
-            transition: background-color 0.3s ease;
-        }
-        
-        .btn:hover {
-            background-color: #219a52;
-        }
-        
-        .links-section {
-            margin-top: 2rem;
-            padding: 2rem;
-            background: white;
-            border-radius: 8px;
-            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
-        }
-        
-        .links-section h2 {
-            color: #2c3e50;
-            margin-bottom: 1rem;
-            padding-bottom: 0.5rem;
-            border-bottom: 2px solid #3498db;
-        }
-        
-        .links-grid {
-            display: grid;
-            grid-template-columns: 1fr 1fr;
-            gap: 2rem;
-        }
-        
-        .link-group h3 {
-            color: #34495e;
-            margin-bottom: 1rem;
-            font-size: 1.1rem;
-        }
-        
-        .link-item {
-            display: flex;
-            justify-content: space-between;
-            align-items: center;
-            padding: 0.75rem;
-            border: 1px solid #eee;
-            border-radius: 4px;
-            margin-bottom: 0.5rem;
-            background-color: #fafafa;
-        }
-        
-        .link-item:hover {
-            background-color: #f0f0f0;
-        }
-        
-        .link-url {
-            color: #3498db;
-            text-decoration: none;
-            font-family: monospace;
-            font-size: 0.9rem;
-            font-weight: 500;
-        }
-        
-        .link-url:hover {
-            text-decoration: underline;
-        }
-        
-        .link-time {
-            color: #7f8c8d;
-            font-size: 0.8rem;
-        }
-        
-        .empty-state {
-            text-align: center;
-            color: #7f8c8d;
-            font-style: italic;
-            padding: 2rem;
-        }
-        
-        .copy-btn {
-            background: #3498db;
-            color: white;
-            border: none;
-            padding: 0.25rem 0.5rem;
-            border-radius: 3px;
-            cursor: pointer;
-            font-size: 0.8rem;
-        }
-        
-        .copy-btn:hover {
-            background: #2980b9;
-        }
-        
-        .delete-btn {
-            background: #e74c3c;
-            color: white;
-            border: none;
-            padding: 0.25rem 0.5rem;
-            border-radius: 3px;
-            cursor: pointer;
-            font-size: 0.8rem;
-            margin-left: 0.25rem;
-        }
-        
-        .delete-btn:hover {
-            background: #c0392b;
-        }
-        
-        .action-buttons {
-            display: flex;
-            gap: 0.25rem;
-            align-items: center;
-        }
-        
-        .expiry-notice {
-            background: #fff3cd;
-            border: 1px solid #ffeaa7;
-            color: #856404;
-            padding: 0.75rem;
-            border-radius: 4px;
-            margin-bottom: 1rem;
-            font-size: 0.9rem;
-        }
-        
-        @media (max-width: 768px) {
-            .container {
-                flex-direction: column;
-                padding: 1rem;
-            }
-            
-            .panel {
-                padding: 1rem;
-            }
-            
-            .links-grid {
-                grid-template-columns: 1fr;
-            }
-        }
-    </style>
-</head>
-<body>
-    <div class="header">
-        <h1>🚀 Clip - Private Sharing</h1>
-        <p>Share text & files with memorable URLs • Auto-expires in 12 hours</p>
-    </div>
-    
-    <div class="expiry-notice">
-        ⏰ <strong>Auto-Cleanup:</strong> All content is automatically deleted after 12 hours for privacy and security.
-    </div>
-    
-    <div class="container">
-        <!-- Left Panel: New Clipboard Entry -->
-        <div class="panel clipboard-panel">
-            <h2>📋 Share Text</h2>
-            <form method="POST" action="/clipboard">
-                <textarea name="content" placeholder="Paste your text here..." required></textarea>
-                <button type="submit" class="btn">Generate Link</button>
-            </form>
-        </div>
-        
-        <!-- Right Panel: File Upload -->
-        <div class="panel upload-panel">
-            <h2>📁 Share Files</h2>
-            <form method="POST" action="/upload" enctype="multipart/form-data">
-                <div class="upload-area" onclick="document.getElementById('fileInput').click()">
-                    <input type="file" name="file" id="fileInput" multiple style="display: none;">
-                    <div style="font-size: 3rem; margin-bottom: 1rem;">📎</div>
-                    <div style="font-size: 1.2rem; margin-bottom: 1rem;">Drop files here or click to browse</div>
-                    <div class="upload-btn" style="pointer-events: none;">
-                        Choose Files
-                    </div>
-                </div>
-                <button type="submit" class="btn">Generate Links</button>
-            </form>
-        </div>
-    </div>
-    
-    <div class="links-section">
-        <h2>🔗 Your Recent Links</h2>
-        <div class="links-grid">
-            <div class="link-group">
-                <h3>📋 Text Shares</h3>
-                {{if .ClipboardEntries}}
-                    {{range .ClipboardEntries}}
-                    <div class="link-item" id="clipboard-{{.ID}}">
-                        <a href="/c/{{.ID}}" class="link-url" target="_blank">{{.ID}}</a>
-                        <div style="display: flex; gap: 0.5rem; align-items: center;">
-                            <span class="link-time">{{.CreatedAt.Format "Jan 2, 15:04"}}</span>
-                            <div class="action-buttons">
-                                <button class="copy-btn" onclick="copyToClipboard('{{.ID}}', 'c')">Copy</button>
-                                <button class="delete-btn" onclick="deleteShare('{{.ID}}', 'c')" title="Delete share">🗑️</button>
-                            </div>
-                        </div>
-                    </div>
-                    {{end}}
-                {{else}}
-                    <div class="empty-state">No text shares yet</div>
-                {{end}}
-            </div>
-            
-            <div class="link-group">
-                <h3>📁 File Shares</h3>
-                {{if .FileEntries}}
-                    {{range .FileEntries}}
-                    <div class="link-item" id="file-{{.ID}}">
-                        <a href="/f/{{.ID}}" class="link-url" target="_blank">{{.ID}} <small>({{.Filename}})</small></a>
-                        <div style="display: flex; gap: 0.5rem; align-items: center;">
-                            <span class="link-time">{{.CreatedAt.Format "Jan 2, 15:04"}}</span>
-                            <div class="action-buttons">
-                                <button class="copy-btn" onclick="copyToClipboard('{{.ID}}', 'f')">Copy</button>
-                                <button class="delete-btn" onclick="deleteShare('{{.ID}}', 'f')" title="Delete share">🗑️</button>
-                            </div>
-                        </div>
-                    </div>
-                    {{end}}
-                {{else}}
-                    <div class="empty-state">No file shares yet</div>
-                {{end}}
-            </div>
-        </div>
-    </div>
-    
-    {{if .Message}}
-    <div class="message">{{.Message}}</div>
-    {{end}}
-    
-    <script>
-        // Handle drag and drop
-        const uploadArea = document.querySelector('.upload-area');
-        const fileInput = document.getElementById('fileInput');
-        
-        uploadArea.addEventListener('dragover', (e) => {
-            e.preventDefault();
-            uploadArea.style.backgroundColor = '#e8f4f8';
-        });
-        
-        uploadArea.addEventListener('dragleave', (e) => {
-            e.preventDefault();
-            uploadArea.style.backgroundColor = '#f8f9fa';
-        });
-        
-        uploadArea.addEventListener('drop', (e) => {
-            e.preventDefault();
-            uploadArea.style.backgroundColor = '#f8f9fa';
-            fileInput.files = e.dataTransfer.files;
-            updateFileDisplay();
-        });
-        
-        fileInput.addEventListener('change', updateFileDisplay);
-        
-        function updateFileDisplay() {
-            const files = fileInput.files;
-            const uploadBtn = document.querySelector('.upload-btn');
-            if (files.length > 0) {
-                uploadBtn.textContent = files.length === 1 ? '1 file selected' : files.length + ' files selected';
-            } else {
-                uploadBtn.textContent = 'Choose Files';
-            }
-        }
-        
-        function copyToClipboard(id, type) {
-            const url = window.location.origin + '/' + type + '/' + id;
-            navigator.clipboard.writeText(url).then(() => {
-                // Brief visual feedback
-                event.target.textContent = 'Copied!';
-                setTimeout(() => {
-                    event.target.textContent = 'Copy';
-                }, 1000);
-            });
-        }
-        
-        function deleteShare(id, type) {
-            if (!confirm('Are you sure you want to delete this share? This action cannot be undone.')) {
-                return;
-            }
-            
-            const deleteUrl = '/delete/' + type + '/' + id;
-            
-            fetch(deleteUrl, {
-                method: 'POST',
-                headers: {
-                    'Accept': 'application/json'
-                }
-            })
-            .then(response => {
-                if (response.ok) {
-                    // Remove the item from the DOM
-                    const elementId = (type === 'c' ? 'clipboard-' : 'file-') + id;
-                    const element = document.getElementById(elementId);
-                    if (element) {
-                        element.style.opacity = '0.5';
-                        element.style.transition = 'opacity 0.3s ease';
-                        setTimeout(() => {
-                            element.remove();
-                            
-                            // Check if sections are empty and show empty state
-                            updateEmptyStates();
-                        }, 300);
-                    }
-                } else {
-                    alert('Failed to delete share. Please try again.');
-                }
-            })
-            .catch(error => {
-                console.error('Error deleting share:', error);
-                alert('Failed to delete share. Please try again.');
-            });
-        }
-        
-                 function updateEmptyStates() {
-             // Check clipboard section
-             const clipboardSection = document.querySelector('.link-group:first-child');
-             const clipboardItems = clipboardSection.querySelectorAll('.link-item');
-             if (clipboardItems.length === 0) {
-                 clipboardSection.innerHTML = '<h3>&#128203; Text Shares</h3><div class="empty-state">No text shares yet</div>';
-             }
-             
-             // Check file section
-             const fileSection = document.querySelector('.link-group:last-child');
-             const fileItems = fileSection.querySelectorAll('.link-item');
-             if (fileItems.length === 0) {
-                 fileSection.innerHTML = '<h3>&#128193; File Shares</h3><div class="empty-state">No file shares yet</div>';
-             }
-         }
-    </script>
-</body>
-</html>
-`
-
-	t, err := template.New("index").Parse(tmpl)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if err := t.Execute(w, data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+		ClipboardEntries: managedShares(r, KindText),
+		FileEntries:      managedShares(r, KindFile),
+		BundleEntries:    managedShares(r, KindBundle),
+		CSRFToken:        csrfToken(w, r),
+		Languages:        languages,
+	}
+	entriesMu.Unlock()
+	renewManageCookies(w, r, data.ClipboardEntries...)
+	renewManageCookies(w, r, data.FileEntries...)
+	renewManageCookies(w, r, data.BundleEntries...)
+
+	render(w, "index.html", data)
 }
 
 func clipboardHandler(w http.ResponseWriter, r *http.Request) {
@@ -642,40 +219,106 @@ func clipboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A live scratchpad may start out empty
 	content := r.FormValue("content")
-	if strings.TrimSpace(content) == "" {
+	live := r.FormValue("live") != ""
+	if strings.TrimSpace(content) == "" && !live {
 		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
 		return
 	}
 
-	// Generate unique readable ID
-	id := generateReadableID()
-	
-	// Ensure uniqueness (though collisions are extremely rare)
-	for _, exists := clipboardEntries[id]; exists; {
-		id = generateReadableID()
+	if err := checkCapacity(int64(len(content))); err != nil {
+		rejectStorageFull(w)
+		return
 	}
-	
-	entry := ClipboardEntry{
-		ID:        id,
-		Content:   content,
-		CreatedAt: time.Now(),
+
+	slug, err := cleanSlug(r.FormValue("slug"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	
-	clipboardEntries[id] = entry
 
-	// Save to file with ID
-	filename := fmt.Sprintf("clipboard_%s.txt", id)
-	filepath := filepath.Join("uploads", filename)
-	
-	if err := os.WriteFile(filepath, []byte(content), 0644); err != nil {
-		log.Printf("Failed to save clipboard content: %v", err)
+	// Use the creator's choice of language, or guess one
+	language := r.FormValue("language")
+	if lookupLanguage(language) == nil {
+		language = detectLanguage(content)
+		// A scratchpad's language is guessed once it's finished
+		if live {
+			language = ""
+		}
 	}
 
-	log.Printf("Created clipboard entry: %s", id)
+	entriesMu.Lock()
 
-	// Redirect back to home
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	room := r.FormValue("room")
+	if room != "" && rooms[room] == nil {
+		entriesMu.Unlock()
+		http.Error(w, "Room not found or expired", http.StatusNotFound)
+		return
+	}
+
+	// Use the chosen slug or generate a unique readable ID
+	id, err := claimID(slug)
+	if err != nil {
+		entriesMu.Unlock()
+		code := http.StatusConflict
+		if errors.Is(err, errNoFreeID) {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	// Save the first revision under a new storage key
+	key := newStorageKey()
+	err = makeBlobDir(key)
+	if err == nil {
+		err = writeUpload(revisionPath(key, 1), []byte(content))
+	}
+	if err != nil {
+		entriesMu.Unlock()
+		if errors.Is(err, errStorageFull) {
+			rejectStorageFull(w)
+			return
+		}
+		slog.Error("Failed to save clipboard content", "id", id, "err", err)
+		http.Error(w, "Failed to save clipboard content", http.StatusInternalServerError)
+		return
+	}
+	
+	token, tokenHash := newManageToken()
+	now := time.Now()
+	entry := Share{
+		ID:              id,
+		Kind:            KindText,
+		Language:        language,
+		CreatedAt:       now,
+		Revisions:       []Revision{{Content: content, Language: language, SavedAt: now}},
+		ManageTokenHash: tokenHash,
+		Room:            room,
+		Key:             key,
+	}
+	entry.setContent(content)
+	if live {
+		entry.Flags |= FlagLive
+	}
+	if slug != "" {
+		entry.Flags |= FlagVanity
+	}
+	if err := addShare(r, entry, "bytes", len(content), "language", language, "live", live); err != nil {
+		entriesMu.Unlock()
+		http.Error(w, "Failed to save clipboard content", http.StatusInternalServerError)
+		return
+	}
+	entriesMu.Unlock()
+
+	// Shares posted to a room go back there, live to every device
+	if room != "" {
+		giveManageToken(w, r, id, token)
+		http.Redirect(w, r, "/r/"+room, http.StatusSeeOther)
+		return
+	}
+	shareCreated(w, r, "c", id, token)
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -684,74 +327,289 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(1 << 30) // 1GB max memory
+	// Refuse up front when the declared size already doesn't fit
+	if r.ContentLength > 0 {
+		if err := checkCapacity(r.ContentLength); err != nil {
+			rejectStorageFull(w)
+			return
+		}
+	}
+
+	// The room comes in the query string, as the body is streamed
+	room := r.URL.Query().Get("room")
+	if room != "" {
+		entriesMu.Lock()
+		exists := rooms[room] != nil
+		entriesMu.Unlock()
+		if !exists {
+			http.Error(w, "Room not found or expired", http.StatusNotFound)
+			return
+		}
+	}
+
+	// A custom link may come in the query string or a form field
+	slug, err := cleanSlug(r.URL.Query().Get("slug"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	files := r.MultipartForm.File["file"]
-	if len(files) == 0 {
-		http.Error(w, "No files uploaded", http.StatusBadRequest)
+	// Stream the multipart body straight to disk, staging the files until
+	// the whole upload is in
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	staging, err := os.MkdirTemp("uploads", "tmp_")
+	if err != nil {
+		slog.Error("Failed to create staging directory", "err", err)
+		http.Error(w, "Failed to store the upload", http.StatusInternalServerError)
 		return
 	}
 
-	for _, fileHeader := range files {
-		// Generate unique readable ID for each file
-		id := generateReadableID()
-		
-		// Ensure uniqueness
-		for _, exists := fileEntries[id]; exists; {
-			id = generateReadableID()
+	// Uploaders may ask for photo metadata to be stripped, in a field
+	// that comes before the files
+	strip := stripMetadata || r.URL.Query().Get("strip_metadata") != ""
+	var files []stagedFile
+	discard := func() {
+		for _, f := range files {
+			if err := removeUpload(f.Path); err != nil {
+				slog.Error("Failed to remove staged file", "path", f.Path, "err", err)
+			}
+		}
+		os.Remove(staging)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
 		}
-		
-		// Open the file
-		file, err := fileHeader.Open()
 		if err != nil {
-			log.Printf("Failed to open file %s: %v", fileHeader.Filename, err)
+			discard()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "strip_metadata" {
+			strip = true
+		}
+		if part.FormName() == "slug" {
+			value, _ := io.ReadAll(io.LimitReader(part, maxSlugLength+1))
+			if slug, err = cleanSlug(string(value)); err != nil {
+				part.Close()
+				discard()
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
 			continue
 		}
-		defer file.Close()
-
-		// Use original filename but store with unique ID
-		originalFilename := filepath.Base(fileHeader.Filename)
-		if originalFilename == "" || originalFilename == "." {
-			originalFilename = "upload_" + fmt.Sprintf("%d", time.Now().Unix())
+		if len(files) == maxBundleFiles {
+			part.Close()
+			discard()
+			http.Error(w, fmt.Sprintf("At most %d files can be uploaded at once", maxBundleFiles), http.StatusBadRequest)
+			return
 		}
 
-		// Store file with unique ID as filename
-		ext := filepath.Ext(originalFilename)
-		destPath := filepath.Join("uploads", id+ext)
-
-		// Create the destination file
-		destFile, err := os.Create(destPath)
+		f, err := stageUploadedFile(part, filepath.Join(staging, strconv.Itoa(len(files))))
+		part.Close()
 		if err != nil {
-			log.Printf("Failed to create file %s: %v", destPath, err)
-			continue
+			discard()
+			if errors.Is(err, errStorageFull) {
+				rejectStorageFull(w)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		files = append(files, f)
+		if strip && isJPEG(f.Path) {
+			if err := stripJPEGMetadata(f.Path); err != nil {
+				slog.Warn("Failed to strip photo metadata", "path", f.Path, "err", err)
+				discard()
+				http.Error(w, "Couldn't remove the metadata from "+f.Name+"; it may be damaged", http.StatusBadRequest)
+				return
+			}
+			if err := files[len(files)-1].refresh(); err != nil {
+				slog.Error("Failed to read stripped photo", "path", f.Path, "err", err)
+				discard()
+				http.Error(w, "Failed to store the upload", http.StatusInternalServerError)
+				return
+			}
 		}
-		defer destFile.Close()
+	}
 
-		// Copy the uploaded file to the destination
-		_, err = io.Copy(destFile, file)
-		if err != nil {
-			log.Printf("Failed to copy file %s: %v", destPath, err)
-			continue
+	// One file gets a link of its own; several, or a folder, are grouped
+	// as a bundle
+	token, tokenHash := newManageToken()
+	share := Share{ID: slug, CreatedAt: time.Now(), Room: room, ManageTokenHash: tokenHash}
+	if slug != "" {
+		share.Flags |= FlagVanity
+	}
+	if strip {
+		share.Flags |= FlagStripped
+	}
+	var id, typ string
+	switch {
+	case len(files) == 0:
+		discard()
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
+	case len(files) == 1 && !strings.Contains(files[0].Name, "/"):
+		typ = "f"
+		id, err = saveUploadedFile(r, files[0], share)
+		os.Remove(staging)
+	default:
+		typ = "b"
+		id, err = saveBundle(r, staging, files, share)
+	}
+	if errors.Is(err, errSlugTaken) {
+		discard()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errNoFreeID) {
+		discard()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		discard()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if room != "" {
+		giveManageToken(w, r, id, token)
+		http.Redirect(w, r, "/r/"+room, http.StatusSeeOther)
+		return
+	}
+	shareCreated(w, r, typ, id, token)
+}
+
+// stagedFile is an uploaded file on disk that isn't published yet.
+type stagedFile struct {
+	Name string // original filename, or its path within an uploaded folder
+	Path string
+	Size int64
+	Hash string // hex SHA-256
+}
+
+// refresh updates the size and hash after the file was rewritten.
+func (f *stagedFile) refresh() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	f.Size = info.Size()
+	f.Hash, err = hashFile(f.Path)
+	return err
+}
+
+// stageUploadedFile streams one multipart file part to path.
+func stageUploadedFile(part *multipart.Part, path string) (stagedFile, error) {
+	start := time.Now()
+
+	// Keep the original filename for display. Part.FileName drops the
+	// directories, which folder uploads need, so read the header directly
+	_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	originalFilename, err := cleanUploadPath(params["filename"])
+	if err != nil {
+		return stagedFile{}, err
+	}
+	if originalFilename == "" {
+		originalFilename = "upload_" + fmt.Sprintf("%d", time.Now().Unix())
+	}
+
+	// Create the destination file
+	destFile, err := os.Create(path)
+	if err != nil {
+		slog.Error("Failed to create file", "path", path, "err", err)
+		return stagedFile{}, fmt.Errorf("failed to store %s", originalFilename)
+	}
+
+	// Copy the uploaded file to the destination, watching the size limit
+	// and the remaining storage as it streams in
+	dest := &quotaWriter{w: destFile}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dest, hash), io.LimitReader(part, maxUploadSize+1))
+	if err == nil && n > maxUploadSize {
+		err = fmt.Errorf("%s exceeds the %s upload limit", originalFilename, formatBytes(maxUploadSize))
+	}
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.Warn("Failed to store upload", "path", path, "err", err)
+		if rmErr := removeUpload(path); rmErr != nil {
+			slog.Error("Failed to remove partial file", "path", path, "err", rmErr)
 		}
+		return stagedFile{}, err
+	}
+
+	uploadBytes.observe(float64(n))
+	uploadDuration.observe(time.Since(start).Seconds())
+	return stagedFile{Name: originalFilename, Path: path, Size: n, Hash: hex.EncodeToString(hash.Sum(nil))}, nil
+}
 
-		// Store file entry with original filename for display
-		entry := FileEntry{
-			ID:        id,
-			Filename:  originalFilename,
-			CreatedAt: time.Now(),
+// saveUploadedFile publishes a staged file. entry carries the new share's
+// room, flags and manage token, and the chosen slug as its ID if there is
+// one; otherwise it gets a new readable ID.
+func saveUploadedFile(r *http.Request, f stagedFile, entry Share) (string, error) {
+	entry.Kind = KindFile
+	entry.Filename = f.Name
+	entry.Size = f.Size
+	entry.Hash = f.Hash
+	entry.MIME = detectMIME(f.Path, f.Name)
+
+	entry.Key = newStorageKey()
+	destPath := blobPath(entry.Key)
+	if err := makeBlobDir(entry.Key); err != nil {
+		slog.Error("Failed to store file", "path", destPath, "err", err)
+		return "", fmt.Errorf("failed to store %s", f.Name)
+	}
+
+	// Claim the ID and move the file into place while it can't be taken
+	entriesMu.Lock()
+	id, err := claimID(entry.ID)
+	if err != nil {
+		entriesMu.Unlock()
+		return "", err
+	}
+	if err := os.Rename(f.Path, destPath); err != nil {
+		entriesMu.Unlock()
+		slog.Error("Failed to store file", "path", destPath, "err", err)
+		return "", fmt.Errorf("failed to store %s", f.Name)
+	}
+
+	// Store file entry with original filename for display
+	entry.ID = id
+	if err := addShare(r, entry, "filename", f.Name, "bytes", f.Size); err != nil {
+		entriesMu.Unlock()
+		return "", fmt.Errorf("failed to store %s", f.Name)
+	}
+	entriesMu.Unlock()
+
+	if thumb := makeThumbnail(entry.Key, destPath); thumb != "" {
+		entriesMu.Lock()
+		if entry, exists := findShare(KindFile, id); exists {
+			entry.Thumbnail = thumb
+			putShare(entry)
+		} else {
+			removeThumbnail(Share{Thumbnail: thumb})
 		}
-		
-		fileEntries[id] = entry
-		log.Printf("Created file entry: %s (%s)", id, originalFilename)
+		entriesMu.Unlock()
 	}
+	return id, nil
+}
 
-	// Redirect back to home
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+// rejectStorageFull answers an upload that doesn't fit. Space comes back as
+// shares expire.
+func rejectStorageFull(w http.ResponseWriter) {
+	http.Error(w, "Storage is nearly full, so new uploads are temporarily disabled. Space frees up as shares expire; please try again later.", http.StatusInsufficientStorage)
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -768,60 +626,29 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	entryType := parts[0] // "c" for clipboard or "f" for file
+	kind, ok := shareKinds[parts[0]] // "c" for clipboard, "f" for file or "b" for bundle
 	id := parts[1]
-	
-	var deleted bool
-	
-	switch entryType {
-	case "c":
-		// Delete clipboard entry
-		if _, exists := clipboardEntries[id]; exists {
-			delete(clipboardEntries, id)
-			
-			// Remove file
-			filename := fmt.Sprintf("clipboard_%s.txt", id)
-			filepath := filepath.Join("uploads", filename)
-			if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
-				log.Printf("Failed to remove clipboard file %s: %v", filepath, err)
-			}
-			
-			deleted = true
-			log.Printf("Deleted clipboard entry: %s", id)
-		}
-		
-	case "f":
-		// Delete file entry
-		if _, exists := fileEntries[id]; exists {
-			delete(fileEntries, id)
-			
-			// Find and remove the actual file
-			files, err := os.ReadDir("uploads")
-			if err == nil {
-				for _, file := range files {
-					if strings.HasPrefix(file.Name(), id) {
-						filepath := filepath.Join("uploads", file.Name())
-						if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
-							log.Printf("Failed to remove file %s: %v", filepath, err)
-						}
-						break
-					}
-				}
-			}
-			
-			deleted = true
-			log.Printf("Deleted file entry: %s", id)
-		}
-		
-	default:
+	if !ok {
 		http.Error(w, "Invalid entry type", http.StatusBadRequest)
 		return
 	}
 	
-	if !deleted {
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+
+	entry, exists := findShare(kind, id)
+	if !exists {
 		http.Error(w, "Entry not found", http.StatusNotFound)
 		return
 	}
+	// Only the creator may delete a share
+	if !canManage(r, id, entry.ManageTokenHash) {
+		http.Error(w, "Only the share's creator can delete it", http.StatusForbidden)
+		return
+	}
+	removeShare(entry)
+	sharesDeleted.inc(string(kind))
+	audit(r, "deleted", string(kind), id)
 	
 	// Return success for AJAX requests
 	if r.Header.Get("Content-Type") == "application/json" || r.Header.Get("Accept") == "application/json" {
@@ -835,192 +662,173 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func clipboardViewHandler(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/c/")
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/c/"), "/")
 	if id == "" {
 		http.Error(w, "Invalid clipboard ID", http.StatusBadRequest)
 		return
 	}
+	switch rest {
+	case "edit":
+		editClipboardHandler(w, r, id)
+		return
+	case "diff":
+		diffHandler(w, r, id)
+		return
+	case "events":
+		padEventsHandler(w, r, id)
+		return
+	case "ops":
+		padOpHandler(w, r, id)
+		return
+	case "finish":
+		finishPadHandler(w, r, id)
+		return
+	}
 
-	entry, exists := clipboardEntries[id]
+	entry, exists := getShare(KindText, id)
 	if !exists {
 		http.Error(w, "Clipboard entry not found or expired", http.StatusNotFound)
 		return
 	}
 
-	// Calculate remaining time
-	expiresAt := entry.CreatedAt.Add(12 * time.Hour)
-	timeLeft := time.Until(expiresAt)
-	
-	// Simple HTML page to display clipboard content
-	tmpl := `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>📋 {{.ID}} - Clip</title>
-    <style>
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
-            background-color: #f5f5f5;
-            margin: 0;
-            padding: 2rem;
-        }
-        .container {
-            max-width: 800px;
-            margin: 0 auto;
-            background: white;
-            border-radius: 8px;
-            padding: 2rem;
-            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
-        }
-        .header {
-            border-bottom: 2px solid #3498db;
-            padding-bottom: 1rem;
-            margin-bottom: 2rem;
-        }
-        .content {
-            background: #f8f9fa;
-            border: 1px solid #e0e0e0;
-            border-radius: 4px;
-            padding: 1rem;
-            font-family: 'Courier New', monospace;
-            white-space: pre-wrap;
-            word-wrap: break-word;
-            line-height: 1.5;
-        }
-        .meta {
-            margin-top: 1rem;
-            color: #7f8c8d;
-            font-size: 0.9rem;
-        }
-        .btn {
-            background-color: #3498db;
-            color: white;
-            border: none;
-            padding: 0.5rem 1rem;
-            border-radius: 4px;
-            cursor: pointer;
-            text-decoration: none;
-            display: inline-block;
-            margin-top: 1rem;
-            margin-right: 0.5rem;
-        }
-        .expiry-warning {
-            background: #fff3cd;
-            border: 1px solid #ffeaa7;
-            color: #856404;
-            padding: 0.75rem;
-            border-radius: 4px;
-            margin-bottom: 1rem;
-            font-size: 0.9rem;
-        }
-        .url-display {
-            background: #e8f4f8;
-            border: 1px solid #3498db;
-            padding: 0.75rem;
-            border-radius: 4px;
-            font-family: monospace;
-            margin-bottom: 1rem;
-            color: #2c3e50;
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="url-display">
-            🔗 <strong>Share URL:</strong> {{.URL}}
-        </div>
-        
-        {{if .TimeLeft}}
-        <div class="expiry-warning">
-            ⏰ <strong>Auto-expires in:</strong> {{.TimeLeft}}
-        </div>
-        {{end}}
-        
-        <div class="header">
-            <h1>📋 {{.ID}}</h1>
-            <p>Created: {{.CreatedAt.Format "January 2, 2006 at 15:04 MST"}}</p>
-        </div>
-        <div class="content">{{.Content}}</div>
-        <div class="meta">
-            <a href="/" class="btn">← Back to Home</a>
-            <button class="btn" onclick="copyToClipboard()">Copy Content</button>
-        </div>
-    </div>
-    
-    <script>
-        function copyToClipboard() {
-            const content = document.querySelector('.content').textContent;
-            navigator.clipboard.writeText(content).then(() => {
-                event.target.textContent = 'Copied!';
-                setTimeout(() => {
-                    event.target.textContent = 'Copy Content';
-                }, 1000);
-            });
-        }
-    </script>
-</body>
-</html>
-`
-
-	data := struct {
-		ClipboardEntry
-		URL      string
-		TimeLeft string
-	}{
-		ClipboardEntry: entry,
-		URL:            r.Host + r.URL.Path,
-		TimeLeft:       formatDuration(timeLeft),
+	// /c/{id}/v/{n} shows an earlier revision; /raw works under both
+	version := len(entry.Revisions)
+	base := "/c/" + id
+	if n, ok := strings.CutPrefix(rest, "v/"); ok {
+		n, rest, _ = strings.Cut(n, "/")
+		var err error
+		if version, err = strconv.Atoi(n); err != nil || version < 1 || version > len(entry.Revisions) {
+			http.Error(w, "No such version", http.StatusNotFound)
+			return
+		}
+		base += "/v/" + n
+	}
+	if rest != "" && rest != "raw" {
+		http.NotFound(w, r)
+		return
 	}
+	rev := entry.Revisions[version-1]
 
-	t, err := template.New("clipboard").Parse(tmpl)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	countView(entry)
+
+	// A live scratchpad opens in the editor; the saved text is still
+	// available raw
+	if entry.Live() && rest == "" && version == len(entry.Revisions) {
+		audit(r, "viewed", "text", id, "live", true)
+		padPage(w, r, entry)
 		return
 	}
 
-	if err := t.Execute(w, data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The original text, exactly as pasted
+	if rest == "raw" {
+		audit(r, "viewed", "text", id, "version", version, "raw", true)
+		sandboxUserContent(w)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, rev.Content)
 		return
 	}
+	audit(r, "viewed", "text", id, "version", version)
+
+	// Calculate remaining time
+	timeLeft := time.Until(entry.ExpiresAt)
+	
+	data := struct {
+		Share
+		URL           string
+		Base          string
+		TimeLeft      string
+		LanguageLabel string
+		Lines         []codeLine
+		Markdown      bool
+		Rendered      template.HTML
+		Version       int
+		Latest        bool
+		History       []revisionLink
+		CanEdit       bool
+	}{
+		Share:    entry,
+		URL:      r.Host + r.URL.Path,
+		Base:     base,
+		TimeLeft: formatDuration(timeLeft),
+		Markdown: rev.Language == "markdown" && len(rev.Content) <= maxMarkdownSize,
+		Version:  version,
+		Latest:   version == len(entry.Revisions),
+		History:  revisionLinks(entry, version),
+		CanEdit:  canManage(r, id, entry.ManageTokenHash),
+	}
+	// Markdown is shown rendered unless the source was asked for
+	if data.Markdown && r.URL.Query().Get("view") != "source" {
+		data.Rendered = cachedMarkdown(rev.Content)
+	} else {
+		data.Lines = highlight(rev.Content, rev.Language)
+	}
+	if lang := lookupLanguage(rev.Language); lang != nil {
+		data.LanguageLabel = lang.Label
+	}
+	renewManageCookies(w, r, entry)
+
+	render(w, "clipboard.html", data)
 }
 
+// fileViewHandler serves /f/{id}, a file share, /f/{id}/thumb, an image's
+// thumbnail, and /f/{id}/x/{n}, one file from inside an uploaded archive.
+// Browsers opening an archive or an image get a page showing what's in it;
+// everything else gets the file itself.
 func fileViewHandler(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/f/")
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/f/"), "/")
 	if id == "" {
 		http.Error(w, "Invalid file ID", http.StatusBadRequest)
 		return
 	}
 
-	entry, exists := fileEntries[id]
+	entry, exists := getShare(KindFile, id)
 	if !exists {
 		http.Error(w, "File not found or expired", http.StatusNotFound)
 		return
 	}
 
-	// Find the actual file (could have different extension)
-	var filepath string
-	files, err := os.ReadDir("uploads")
-	if err != nil {
-		http.Error(w, "Error reading uploads directory", http.StatusInternalServerError)
+	filepath := blobPath(entry.Key)
+
+	if member, ok := strings.CutPrefix(rest, "x/"); ok {
+		archiveMemberHandler(w, r, entry, filepath, member)
+		return
+	}
+	if rest == "thumb" {
+		thumbnailHandler(w, r, entry)
+		return
+	}
+	if rest != "" {
+		http.NotFound(w, r)
 		return
 	}
 
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), id) {
-			filepath = "uploads/" + file.Name()
-			break
+	w.Header().Set("Vary", "Accept")
+	if wantsPage(r) {
+		index := archiveFor(id, filepath)
+		if index != nil || entry.Thumbnail != "" {
+			info, err := os.Stat(filepath)
+			if err != nil {
+				http.Error(w, "File not found on disk", http.StatusNotFound)
+				return
+			}
+			if index != nil {
+				archivePage(w, r, entry, index, info.Size())
+			} else {
+				imagePage(w, r, entry, info.Size())
+			}
+			return
 		}
 	}
 
-	if filepath == "" {
-		http.Error(w, "File not found on disk", http.StatusNotFound)
-		return
-	}
+	countView(entry)
+	audit(r, "downloaded", "file", id, "filename", entry.Filename)
 
-	// Set filename for download
+	// Set filename for download, and make sure the browser never renders
+	// the upload as part of our origin
+	sandboxUserContent(w)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", entry.Filename))
+	// The stored file has no extension to go by
+	w.Header().Set("Content-Type", entry.MIME)
 	
 	// Serve the file
 	http.ServeFile(w, r, filepath)
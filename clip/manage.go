@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manage tokens let whoever created a share change it later. Only a hash is
+// kept; the token itself goes to the creator in a per-share cookie and in
+// the X-Manage-Token response header, for use from scripts or other
+// devices.
+
+const manageCookiePrefix = "clip_m_"
+
+// newManageToken returns a fresh token and the hash to store.
+func newManageToken() (token, hash string) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token = hex.EncodeToString(b)
+	return token, hashManageToken(token)
+}
+
+func hashManageToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// giveManageToken hands a share's token to the client that created it. The
+// caller doesn't hold entriesMu.
+func giveManageToken(w http.ResponseWriter, r *http.Request, id, token string) {
+	expiresAt := time.Now().Add(shareTTL)
+	entriesMu.Lock()
+	if s, ok := shares[id]; ok {
+		expiresAt = s.ExpiresAt
+	}
+	entriesMu.Unlock()
+	setManageCookie(w, r, id, token, expiresAt)
+	w.Header().Set("X-Manage-Token", token)
+}
+
+// setManageCookie stores a share's token in a cookie that lasts as long as
+// the share.
+func setManageCookie(w http.ResponseWriter, r *http.Request, id, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     manageCookiePrefix + id,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   max(1, int(time.Until(expiresAt).Seconds())),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// renewManageCookies sets the manage cookies the browser holds for list
+// again, so that they follow the shares' expiry when the admin dashboard
+// moves it.
+func renewManageCookies(w http.ResponseWriter, r *http.Request, list ...Share) {
+	for _, s := range list {
+		c, err := r.Cookie(manageCookiePrefix + s.ID)
+		if err == nil && tokenMatches(c.Value, s.ManageTokenHash) {
+			setManageCookie(w, r, s.ID, c.Value, s.ExpiresAt)
+		}
+	}
+}
+
+// manageToken returns the token presented for share id: an
+// "Authorization: Bearer" header, a token form or query value, or the
+// share's cookie.
+func manageToken(r *http.Request, id string) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if token := r.FormValue("token"); token != "" {
+		return token
+	}
+	if c, err := r.Cookie(manageCookiePrefix + id); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// canManage reports whether r carries the manage token matching hash.
+func canManage(r *http.Request, id, hash string) bool {
+	return tokenMatches(manageToken(r, id), hash)
+}
+
+func tokenMatches(token, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashManageToken(token)), []byte(hash)) == 1
+}
+
+// managedShares lists the unexpired shares of one kind whose manage cookies
+// the browser holds, newest first: the ones it created. The caller holds
+// entriesMu.
+func managedShares(r *http.Request, kind ShareKind) []Share {
+	var list []Share
+	for _, c := range r.Cookies() {
+		id, ok := strings.CutPrefix(c.Name, manageCookiePrefix)
+		if !ok {
+			continue
+		}
+		if s, ok := findShare(kind, id); ok && tokenMatches(c.Value, s.ManageTokenHash) {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
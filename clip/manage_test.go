@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestManageCookieFollowsExpiry(t *testing.T) {
+	const id = "moved-expiry"
+	token, hash := newManageToken()
+	s := Share{ID: id, Kind: KindText, ManageTokenHash: hash, ExpiresAt: time.Now().Add(30 * time.Hour)}
+	entriesMu.Lock()
+	shares[id] = s
+	entriesMu.Unlock()
+	defer func() {
+		entriesMu.Lock()
+		delete(shares, id)
+		entriesMu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	giveManageToken(w, httptest.NewRequest("POST", "/clipboard", nil), id, token)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge < int((29*time.Hour).Seconds()) {
+		t.Fatalf("gave cookies %v, want one lasting about 30h", cookies)
+	}
+
+	// The admin dashboard moved the expiry; the owner's next visit carries
+	// the cookie along
+	s.ExpiresAt = time.Now().Add(72 * time.Hour)
+	r := httptest.NewRequest("GET", "/c/"+id, nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	renewManageCookies(w, r, s)
+	renewed := w.Result().Cookies()
+	if len(renewed) != 1 || renewed[0].Value != token || renewed[0].MaxAge < int((71*time.Hour).Seconds()) {
+		t.Errorf("renewed cookies %v, want the token for about 72h", renewed)
+	}
+
+	// Someone else's cookie isn't renewed
+	r = httptest.NewRequest("GET", "/c/"+id, nil)
+	r.AddCookie(&http.Cookie{Name: manageCookiePrefix + id, Value: "guess"})
+	w = httptest.NewRecorder()
+	renewManageCookies(w, r, s)
+	if got := w.Result().Cookies(); len(got) != 0 {
+		t.Errorf("renewed a wrong token: %v", got)
+	}
+}
@@ -0,0 +1,1394 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Markdown renderer covering the common CommonMark blocks and inlines plus
+// the GFM table, task list, strikethrough and autolink extensions.
+//
+// It is sanitizing by construction: every piece of source text is escaped,
+// raw HTML is shown as text, and link and image URLs are limited to http,
+// https, mailto and relative references. Nothing a paste contains can run
+// script on the clip origin.
+
+// renderMarkdown converts src to sanitized HTML.
+func renderMarkdown(src string) template.HTML {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+	}
+
+	p := &mdParser{refs: make(map[string]mdLink)}
+	p.collectRefs(lines)
+
+	var b strings.Builder
+	p.blocks(&b, lines, false)
+	return template.HTML(b.String())
+}
+
+const (
+	// maxMarkdownSize is the largest text rendered as Markdown; bigger
+	// ones are shown as highlighted source
+	maxMarkdownSize = 512 << 10
+
+	// markdownCacheSize bounds the rendered HTML kept in memory
+	markdownCacheSize = 32 << 20
+)
+
+// markdownCache keeps recently rendered revisions so a text share that's
+// viewed over and over is only rendered once. Entries are keyed by a hash of
+// the source, so an edit simply misses and the old revision ages out.
+var markdownCache = struct {
+	sync.Mutex
+	order *list.List // front is most recently used
+	items map[[sha256.Size]byte]*list.Element
+	size  int
+}{order: list.New(), items: make(map[[sha256.Size]byte]*list.Element)}
+
+type renderedMarkdown struct {
+	key  [sha256.Size]byte
+	html template.HTML
+}
+
+// cachedMarkdown is renderMarkdown through markdownCache.
+func cachedMarkdown(src string) template.HTML {
+	key := sha256.Sum256([]byte(src))
+	c := &markdownCache
+	c.Lock()
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		c.Unlock()
+		return e.Value.(*renderedMarkdown).html
+	}
+	c.Unlock()
+
+	out := renderMarkdown(src)
+	if len(out) > markdownCacheSize/4 {
+		return out
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.items[key]; ok {
+		return out
+	}
+	c.items[key] = c.order.PushFront(&renderedMarkdown{key, out})
+	c.size += len(out)
+	for c.size > markdownCacheSize {
+		old := c.order.Remove(c.order.Back()).(*renderedMarkdown)
+		delete(c.items, old.key)
+		c.size -= len(old.html)
+	}
+	return out
+}
+
+type mdLink struct {
+	url, title string
+}
+
+type mdParser struct {
+	refs map[string]mdLink
+	// depth counts the blockquotes and lists being rendered
+	depth int
+}
+
+// maxMarkdownNesting bounds nested blockquotes and lists. Deeper markers
+// are rendered as text, so a line of a thousand ">" can't recurse a
+// thousand times.
+const maxMarkdownNesting = 32
+
+var (
+	mdATXHeading = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdThematic   = regexp.MustCompile(`^(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence      = regexp.MustCompile("^(`{3,}|~{3,})[ \t]*([^`]*)$")
+	mdRefDef     = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:[ \t]*<?([^\s>]+)>?(?:[ \t]+(?:"([^"]*)"|'([^']*)'|\(([^)]*)\)))?[ \t]*$`)
+	mdTableDelim = regexp.MustCompile(`^[ \t]*:?-+:?[ \t]*$`)
+	mdTaskItem   = regexp.MustCompile(`^\[([ xX])\](?:[ \t]|$)`)
+)
+
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	var b strings.Builder
+	col := 0
+	for _, r := range line {
+		if r == '\t' {
+			n := 4 - col%4
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(r)
+		col++
+	}
+	return b.String()
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// collectRefs records [label]: url definitions outside code fences, so links
+// may refer to definitions further down.
+func (p *mdParser) collectRefs(lines []string) {
+	fence := ""
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if m := mdFence.FindStringSubmatch(trimmed); m != nil && indentOf(line) < 4 {
+			switch {
+			case fence == "":
+				fence = m[1]
+			case strings.HasPrefix(m[1], fence[:1]) && len(m[1]) >= len(fence) && m[2] == "":
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+		if m := mdRefDef.FindStringSubmatch(line); m != nil {
+			label := normalizeLabel(m[1])
+			if _, exists := p.refs[label]; !exists {
+				p.refs[label] = mdLink{url: m[2], title: m[3] + m[4] + m[5]}
+			}
+		}
+	}
+}
+
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// blockStart reports whether line opens a block that interrupts a
+// paragraph.
+func blockStart(line string) bool {
+	if indentOf(line) >= 4 {
+		return false
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	if mdATXHeading.MatchString(trimmed) || mdThematic.MatchString(trimmed) || mdFence.MatchString(trimmed) ||
+		strings.HasPrefix(trimmed, ">") {
+		return true
+	}
+	if item, ok := parseListMarker(line); ok && !isBlank(line[item.contentOffset:]) {
+		// Only bullets and lists starting at 1 may interrupt a paragraph
+		return !item.ordered || item.start == 1
+	}
+	return false
+}
+
+// blocks renders a sequence of block-level lines. In tight list items
+// paragraphs are rendered without <p> tags.
+func (p *mdParser) blocks(b *strings.Builder, lines []string, tight bool) {
+	i := 0
+	for i < len(lines) {
+		line := lines[i]
+		if isBlank(line) {
+			i++
+			continue
+		}
+		indent := indentOf(line)
+		trimmed := line[indent:]
+
+		// Indented code block
+		if indent >= 4 {
+			var code []string
+			for i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4) {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+				i++
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>")
+			b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			b.WriteString("</code></pre>\n")
+			continue
+		}
+
+		// Fenced code block
+		if m := mdFence.FindStringSubmatch(trimmed); m != nil {
+			fence, info := m[1], strings.TrimSpace(m[2])
+			i++
+			var code []string
+			for i < len(lines) {
+				t := strings.TrimSpace(lines[i])
+				if strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" && indentOf(lines[i]) < 4 {
+					i++
+					break
+				}
+				l := lines[i]
+				strip := indent
+				if n := indentOf(l); n < strip {
+					strip = n
+				}
+				code = append(code, l[strip:])
+				i++
+			}
+			p.codeBlock(b, strings.Join(code, "\n"), info)
+			continue
+		}
+
+		if m := mdATXHeading.FindStringSubmatch(trimmed); m != nil {
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">")
+			p.inline(b, strings.TrimSpace(m[2]))
+			b.WriteString("</h" + level + ">\n")
+			i++
+			continue
+		}
+
+		if mdThematic.MatchString(trimmed) {
+			b.WriteString("<hr>\n")
+			i++
+			continue
+		}
+
+		// Blockquote, with lazy continuation of paragraph lines
+		if strings.HasPrefix(trimmed, ">") && p.depth < maxMarkdownNesting {
+			var inner []string
+			for i < len(lines) && !isBlank(lines[i]) {
+				t := strings.TrimLeft(lines[i], " ")
+				if strings.HasPrefix(t, ">") && indentOf(lines[i]) < 4 {
+					t = strings.TrimPrefix(t[1:], " ")
+				} else if blockStart(lines[i]) {
+					break
+				}
+				inner = append(inner, t)
+				i++
+			}
+			b.WriteString("<blockquote>\n")
+			p.depth++
+			p.blocks(b, inner, false)
+			p.depth--
+			b.WriteString("</blockquote>\n")
+			continue
+		}
+
+		if i+1 < len(lines) && strings.Contains(line, "|") && isTableDelimiter(lines[i+1], len(splitTableRow(line))) {
+			i = p.table(b, lines, i)
+			continue
+		}
+
+		if _, ok := parseListMarker(line); ok && p.depth < maxMarkdownNesting {
+			i = p.list(b, lines, i)
+			continue
+		}
+
+		// Paragraph, possibly turned into a setext heading
+		var para []string
+		level := 0
+		for i < len(lines) && !isBlank(lines[i]) {
+			if len(para) > 0 {
+				t := strings.TrimSpace(lines[i])
+				if indentOf(lines[i]) < 4 && t != "" && strings.Trim(t, "=") == "" {
+					level = 1
+					i++
+					break
+				}
+				if indentOf(lines[i]) < 4 && t != "" && strings.Trim(t, "-") == "" {
+					level = 2
+					i++
+					break
+				}
+				if blockStart(lines[i]) {
+					break
+				}
+			}
+			if mdRefDef.MatchString(lines[i]) && len(para) == 0 {
+				i++
+				continue
+			}
+			para = append(para, strings.TrimLeft(lines[i], " "))
+			i++
+		}
+		if len(para) == 0 {
+			continue
+		}
+		text := strings.TrimRight(strings.Join(para, "\n"), " ")
+		switch {
+		case level > 0:
+			tag := "h" + strconv.Itoa(level)
+			b.WriteString("<" + tag + ">")
+			p.inline(b, text)
+			b.WriteString("</" + tag + ">\n")
+		case tight:
+			p.inline(b, text)
+			b.WriteString("\n")
+		default:
+			b.WriteString("<p>")
+			p.inline(b, text)
+			b.WriteString("</p>\n")
+		}
+	}
+}
+
+// fenceLanguages maps common fence info strings to highlighter languages.
+var fenceLanguages = map[string]string{
+	"golang": "go", "py": "python", "js": "javascript", "ts": "typescript",
+	"sh": "shell", "bash": "shell", "zsh": "shell", "console": "shell",
+	"c++": "cpp", "rs": "rust", "yml": "yaml", "xml": "html",
+}
+
+// codeBlock renders a fenced code block, highlighting it when the info
+// string names a known language.
+func (p *mdParser) codeBlock(b *strings.Builder, code, info string) {
+	name, _, _ := strings.Cut(info, " ")
+	name = strings.ToLower(name)
+	if alias, ok := fenceLanguages[name]; ok {
+		name = alias
+	}
+	if name == "" || name == "markdown" || lookupLanguage(name) == nil {
+		b.WriteString("<pre><code>")
+		b.WriteString(html.EscapeString(code))
+		b.WriteString("</code></pre>\n")
+		return
+	}
+	b.WriteString(`<pre><code class="language-` + name + `">`)
+	for i, line := range highlight(code, name) {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(string(line.HTML))
+	}
+	b.WriteString("</code></pre>\n")
+}
+
+type listMarker struct {
+	ordered       bool
+	delim         byte // '-', '*', '+', '.' or ')'
+	start         int
+	contentOffset int
+}
+
+// parseListMarker recognises "- ", "* ", "+ ", "1. " and "1) " items.
+func parseListMarker(line string) (listMarker, bool) {
+	indent := indentOf(line)
+	if indent >= 4 {
+		return listMarker{}, false
+	}
+	rest := line[indent:]
+	var m listMarker
+	width := 0
+	switch {
+	case rest != "" && strings.IndexByte("-*+", rest[0]) >= 0:
+		m.delim = rest[0]
+		width = 1
+	default:
+		digits := 0
+		for digits < len(rest) && digits < 9 && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 || digits >= len(rest) || (rest[digits] != '.' && rest[digits] != ')') {
+			return listMarker{}, false
+		}
+		m.ordered = true
+		m.delim = rest[digits]
+		m.start, _ = strconv.Atoi(rest[:digits])
+		width = digits + 1
+	}
+	after := rest[width:]
+	if after != "" && after[0] != ' ' {
+		return listMarker{}, false
+	}
+	// A line of nothing but the bullet and spaces may be a thematic break
+	if !m.ordered && strings.Trim(rest, " \t"+string(m.delim)) == "" && mdThematic.MatchString(rest) {
+		return listMarker{}, false
+	}
+	spaces := indentOf(after)
+	if spaces > 4 || strings.TrimSpace(after) == "" {
+		spaces = 1
+	}
+	m.contentOffset = indent + width + spaces
+	if m.contentOffset > len(line) {
+		m.contentOffset = len(line)
+	}
+	return m, true
+}
+
+// list renders the list starting at lines[i] and returns the index of the
+// first line after it.
+func (p *mdParser) list(b *strings.Builder, lines []string, i int) int {
+	first, _ := parseListMarker(lines[i])
+	var items [][]string
+	var current []string
+	offset := 0
+	loose := false
+	sawBlank := false
+
+	for i < len(lines) {
+		line := lines[i]
+		if isBlank(line) {
+			// A blank line continues the list only if more of it follows
+			j := i + 1
+			for j < len(lines) && isBlank(lines[j]) {
+				j++
+			}
+			if j == len(lines) {
+				break
+			}
+			next := lines[j]
+			m, isItem := parseListMarker(next)
+			sameList := isItem && m.ordered == first.ordered && m.delim == first.delim && indentOf(next) < offset
+			if indentOf(next) < offset && !sameList {
+				break
+			}
+			for ; i < j; i++ {
+				current = append(current, "")
+			}
+			sawBlank = true
+			continue
+		}
+
+		if m, ok := parseListMarker(line); ok && indentOf(line) < offset || ok && current == nil {
+			if m.ordered != first.ordered || m.delim != first.delim {
+				break
+			}
+			if current != nil {
+				items = append(items, current)
+				if sawBlank {
+					loose = true
+				}
+			}
+			sawBlank = false
+			offset = m.contentOffset
+			current = []string{line[offset:]}
+			i++
+			continue
+		}
+
+		switch {
+		case indentOf(line) >= offset:
+			if sawBlank && len(current) > 0 {
+				loose = true
+			}
+			current = append(current, line[offset:])
+		case !sawBlank && !blockStart(line):
+			// Lazy paragraph continuation
+			current = append(current, strings.TrimLeft(line, " "))
+		default:
+			items = append(items, current)
+			current = nil
+		}
+		if current == nil {
+			break
+		}
+		i++
+	}
+	if current != nil {
+		items = append(items, current)
+	}
+
+	tag := "ul"
+	if first.ordered {
+		tag = "ol"
+	}
+	b.WriteString("<" + tag)
+	if first.ordered && first.start != 1 {
+		b.WriteString(` start="` + strconv.Itoa(first.start) + `"`)
+	}
+	task := false
+	for _, item := range items {
+		if len(item) > 0 && mdTaskItem.MatchString(item[0]) {
+			task = true
+		}
+	}
+	if task {
+		b.WriteString(` class="task-list"`)
+	}
+	b.WriteString(">\n")
+
+	for _, item := range items {
+		for len(item) > 0 && isBlank(item[len(item)-1]) {
+			item = item[:len(item)-1]
+		}
+		b.WriteString("<li>")
+		if len(item) > 0 {
+			if m := mdTaskItem.FindStringSubmatch(item[0]); m != nil {
+				if m[1] == " " {
+					b.WriteString(`<input type="checkbox" disabled> `)
+				} else {
+					b.WriteString(`<input type="checkbox" checked disabled> `)
+				}
+				item[0] = strings.TrimLeft(item[0][3:], " ")
+			}
+		}
+		p.depth++
+		p.blocks(b, item, !loose)
+		p.depth--
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func isTableDelimiter(line string, columns int) bool {
+	if !strings.Contains(line, "-") || indentOf(line) >= 4 {
+		return false
+	}
+	cells := splitTableRow(line)
+	if len(cells) != columns {
+		return false
+	}
+	for _, c := range cells {
+		if !mdTableDelim.MatchString(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// table renders a GFM table starting at lines[i].
+func (p *mdParser) table(b *strings.Builder, lines []string, i int) int {
+	header := splitTableRow(lines[i])
+	var align []string
+	for _, c := range splitTableRow(lines[i+1]) {
+		left, right := strings.HasPrefix(c, ":"), strings.HasSuffix(c, ":")
+		switch {
+		case left && right:
+			align = append(align, "center")
+		case right:
+			align = append(align, "right")
+		case left:
+			align = append(align, "left")
+		default:
+			align = append(align, "")
+		}
+	}
+	i += 2
+
+	cell := func(b *strings.Builder, tag, text string, col int) {
+		b.WriteString("<" + tag)
+		if align[col] != "" {
+			b.WriteString(` class="align-` + align[col] + `"`)
+		}
+		b.WriteString(">")
+		p.inline(b, text)
+		b.WriteString("</" + tag + ">")
+	}
+
+	b.WriteString("<table>\n<thead>\n<tr>")
+	for col, text := range header {
+		cell(b, "th", text, col)
+	}
+	b.WriteString("</tr>\n</thead>\n")
+
+	var body strings.Builder
+	for i < len(lines) && !isBlank(lines[i]) && strings.Contains(lines[i], "|") && !blockStart(lines[i]) {
+		row := splitTableRow(lines[i])
+		body.WriteString("<tr>")
+		for col := range header {
+			text := ""
+			if col < len(row) {
+				text = row[col]
+			}
+			cell(&body, "td", text, col)
+		}
+		body.WriteString("</tr>\n")
+		i++
+	}
+	if body.Len() > 0 {
+		b.WriteString("<tbody>\n")
+		b.WriteString(body.String())
+		b.WriteString("</tbody>\n")
+	}
+	b.WriteString("</table>\n")
+	return i
+}
+
+// safeURL allows http, https, mailto and scheme-less URLs; anything else
+// (javascript:, data:, vbscript: ...) is replaced.
+func safeURL(u string) string {
+	u = strings.TrimSpace(u)
+	if i := strings.IndexAny(u, ":/?#"); i >= 0 && u[i] == ':' {
+		scheme := strings.ToLower(u[:i])
+		if scheme != "http" && scheme != "https" && scheme != "mailto" {
+			return "#"
+		}
+	}
+	return u
+}
+
+func isPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
+
+// Inlines are parsed the CommonMark way, which keeps rendering linear in
+// the length of the text however its delimiters are arranged. One pass
+// builds a list of nodes. Runs of *, _ and ~~ that could open or close
+// emphasis go on a delimiter stack, and every [ and ![ on a bracket stack. A
+// ] closes the nearest bracket when a destination or known reference
+// follows it, and emphasis is matched afterwards by walking the delimiter
+// stack, so nothing ever rescans the rest of the text looking for a closer.
+
+type mdNodeKind uint8
+
+const (
+	mdText     mdNodeKind = iota // text, escaped when written
+	mdHTML                       // markup rendered already; text is its plain form
+	mdAutolink                   // a link written out as its URL
+	mdEm
+	mdStrong
+	mdDel
+	mdLinkNode
+	mdImage
+)
+
+type mdNode struct {
+	kind        mdNodeKind
+	text        string
+	html        string
+	link        mdLink
+	first, last *mdNode // children of emphasis, links and images
+	prev, next  *mdNode
+}
+
+// mdDelim is a run of emphasis characters on the delimiter stack. n counts
+// the characters not yet used up; orig is the run's length as written.
+type mdDelim struct {
+	node              *mdNode
+	c                 byte
+	n, orig           int
+	canOpen, canClose bool
+	prev, next        *mdDelim
+}
+
+type mdBracket struct {
+	node   *mdNode
+	image  bool
+	start  int      // of the link text in s
+	seq    int      // order pushed
+	delims *mdDelim // the delimiter stack's top when pushed
+	prev   *mdBracket
+}
+
+type mdInline struct {
+	p        *mdParser
+	s        string
+	root     mdNode
+	delims   *mdDelim
+	brackets *mdBracket
+	seq      int
+	// Link openers pushed before lastLink are inactive: links can't
+	// contain links
+	lastLink int
+
+	// Backtick runs by length, and how far code span searches have got
+	// through each list
+	ticks   map[int][]int
+	tickPos map[int]int
+	// The last search for each title closer
+	found map[byte][2]int
+}
+
+const (
+	// maxLinkLabel is CommonMark's limit on reference labels.
+	maxLinkLabel = 999
+	// maxDestinationParens bounds the parentheses nested in a link
+	// destination, as CommonMark allows.
+	maxDestinationParens = 32
+)
+
+// inline renders inline markup.
+func (p *mdParser) inline(b *strings.Builder, s string) {
+	in := &mdInline{p: p, s: s}
+	in.parse()
+	in.processEmphasis(nil)
+	p.writeInlines(b, in.root.first, false)
+}
+
+func (in *mdInline) append(n *mdNode) *mdNode {
+	n.prev = in.root.last
+	if in.root.last != nil {
+		in.root.last.next = n
+	} else {
+		in.root.first = n
+	}
+	in.root.last = n
+	return n
+}
+
+func (in *mdInline) appendText(text string) *mdNode {
+	return in.append(&mdNode{kind: mdText, text: text})
+}
+
+func (in *mdInline) appendHTML(html, text string) {
+	in.append(&mdNode{kind: mdHTML, html: html, text: text})
+}
+
+func (in *mdInline) parse() {
+	s := in.s
+	plain := 0
+	flush := func(end int) {
+		if plain < end {
+			in.appendText(s[plain:end])
+		}
+	}
+
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			flush(i)
+			in.appendHTML("<br>\n", "\n")
+			i += 2
+			plain = i
+			continue
+
+		case c == '\\' && i+1 < len(s) && isPunct(s[i+1]):
+			flush(i)
+			in.appendText(s[i+1 : i+2])
+			i += 2
+			plain = i
+			continue
+
+		case c == '\n':
+			// Two trailing spaces make a hard break
+			start := i
+			for start > plain && s[start-1] == ' ' {
+				start--
+			}
+			flush(start)
+			if i-start >= 2 {
+				in.appendHTML("<br>\n", "\n")
+			} else {
+				in.appendHTML("\n", "\n")
+			}
+			i++
+			plain = i
+			continue
+
+		case c == '`':
+			n := runLength(s, i, '`')
+			if end := in.codeSpanEnd(i+n, n); end >= 0 {
+				flush(i)
+				code := strings.ReplaceAll(s[i+n:end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				in.appendHTML("<code>"+html.EscapeString(code)+"</code>", code)
+				i = end + n
+				plain = i
+				continue
+			}
+			i += n
+			continue
+
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			flush(i)
+			in.pushBracket(i+2, true)
+			i += 2
+			plain = i
+			continue
+
+		case c == '[':
+			flush(i)
+			in.pushBracket(i+1, false)
+			i++
+			plain = i
+			continue
+
+		case c == ']':
+			flush(i)
+			i = in.closeBracket(i)
+			plain = i
+			continue
+
+		case c == '<':
+			// An autolink can't contain spaces or angle brackets, so the
+			// search stops at the next one
+			if end := strings.IndexAny(s[i+1:], " <>\n"); end > 0 && s[i+1+end] == '>' {
+				target := s[i+1 : i+1+end]
+				if isAutolink(target) {
+					flush(i)
+					href := target
+					if !strings.Contains(target, ":") {
+						href = "mailto:" + target
+					}
+					in.append(&mdNode{kind: mdAutolink, html: autolinkHTML(href, target), text: target})
+					i += end + 2
+					plain = i
+					continue
+				}
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			n := runLength(s, i, c)
+			// Strikethrough takes exactly two tildes
+			if c == '~' && n != 2 {
+				i += n
+				continue
+			}
+			flush(i)
+			in.pushDelim(i, n)
+			i += n
+			plain = i
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	flush(len(s))
+}
+
+func runLength(s string, i int, c byte) int {
+	n := 0
+	for i+n < len(s) && s[i+n] == c {
+		n++
+	}
+	return n
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= utf8.RuneSelf
+}
+
+// codeSpanEnd finds the next backtick run of exactly n at or after from,
+// or -1. The runs are indexed on first use, and searches only ever move
+// forward through them.
+func (in *mdInline) codeSpanEnd(from, n int) int {
+	if in.ticks == nil {
+		in.ticks = make(map[int][]int)
+		in.tickPos = make(map[int]int)
+		for j := 0; j < len(in.s); {
+			if in.s[j] != '`' {
+				j++
+				continue
+			}
+			m := runLength(in.s, j, '`')
+			in.ticks[m] = append(in.ticks[m], j)
+			j += m
+		}
+	}
+	runs, k := in.ticks[n], in.tickPos[n]
+	for k < len(runs) && runs[k] < from {
+		k++
+	}
+	in.tickPos[n] = k
+	if k == len(runs) {
+		return -1
+	}
+	return runs[k]
+}
+
+func isSpaceRune(r rune) bool {
+	return unicode.IsSpace(r)
+}
+
+func isPunctRune(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// pushDelim adds the run of n emphasis characters at s[i] as text, and to
+// the delimiter stack if it could open or close emphasis.
+func (in *mdInline) pushDelim(i, n int) {
+	s, c := in.s, in.s[i]
+	// The start and end of the text count as whitespace
+	before, after := ' ', ' '
+	if i > 0 {
+		before, _ = utf8.DecodeLastRuneInString(s[:i])
+	}
+	if i+n < len(s) {
+		after, _ = utf8.DecodeRuneInString(s[i+n:])
+	}
+	left := !isSpaceRune(after) && (!isPunctRune(after) || isSpaceRune(before) || isPunctRune(before))
+	right := !isSpaceRune(before) && (!isPunctRune(before) || isSpaceRune(after) || isPunctRune(after))
+	canOpen, canClose := left, right
+	if c == '_' {
+		// No emphasis inside snake_case words
+		canOpen = left && (!right || isPunctRune(before))
+		canClose = right && (!left || isPunctRune(after))
+	}
+
+	node := in.appendText(s[i : i+n])
+	if !canOpen && !canClose {
+		return
+	}
+	d := &mdDelim{node: node, c: c, n: n, orig: n, canOpen: canOpen, canClose: canClose, prev: in.delims}
+	if in.delims != nil {
+		in.delims.next = d
+	}
+	in.delims = d
+}
+
+func (in *mdInline) removeDelim(d *mdDelim) {
+	if d.prev != nil {
+		d.prev.next = d.next
+	}
+	if d.next != nil {
+		d.next.prev = d.prev
+	} else {
+		in.delims = d.prev
+	}
+}
+
+// removeNode unlinks a node from the top-level list.
+func (in *mdInline) removeNode(n *mdNode) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		in.root.first = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		in.root.last = n.prev
+	}
+}
+
+// emphasisSlot picks the openers-bottom entry for a closer: CommonMark
+// keeps one per character, length mod 3 and whether the closer can open.
+func emphasisSlot(d *mdDelim) int {
+	slot := strings.IndexByte("*_~", d.c)*6 + d.orig%3
+	if d.canOpen {
+		slot += 3
+	}
+	return slot
+}
+
+// processEmphasis matches up the delimiters above bottom, wrapping the
+// nodes between each pair, then takes them all off the stack. For each
+// kind of closer it remembers how far down a search for an opener failed,
+// so no stretch of the stack is searched twice.
+func (in *mdInline) processEmphasis(bottom *mdDelim) {
+	if in.delims == bottom {
+		return
+	}
+	var openersBottom [18]*mdDelim
+	for i := range openersBottom {
+		openersBottom[i] = bottom
+	}
+
+	closer := in.delims
+	for closer.prev != bottom {
+		closer = closer.prev
+	}
+	for closer != nil {
+		if !closer.canClose {
+			closer = closer.next
+			continue
+		}
+		slot := emphasisSlot(closer)
+		opener := closer.prev
+		for opener != bottom && opener != openersBottom[slot] && !emphasisPair(opener, closer) {
+			opener = opener.prev
+		}
+		if opener == bottom || opener == openersBottom[slot] {
+			openersBottom[slot] = closer.prev
+			next := closer.next
+			if !closer.canOpen {
+				in.removeDelim(closer)
+			}
+			closer = next
+			continue
+		}
+
+		use, kind := 1, mdEm
+		switch {
+		case closer.c == '~':
+			use, kind = 2, mdDel
+		case closer.n >= 2 && opener.n >= 2:
+			use, kind = 2, mdStrong
+		}
+		opener.n -= use
+		closer.n -= use
+		opener.node.text = opener.node.text[:opener.n]
+		closer.node.text = closer.node.text[:closer.n]
+
+		// Everything between the two becomes the emphasis' content
+		wrap := &mdNode{kind: kind}
+		if opener.node.next != closer.node {
+			wrap.first, wrap.last = opener.node.next, closer.node.prev
+			wrap.first.prev, wrap.last.next = nil, nil
+		}
+		wrap.prev, wrap.next = opener.node, closer.node
+		opener.node.next, closer.node.prev = wrap, wrap
+		opener.next, closer.prev = closer, opener
+
+		if opener.n == 0 {
+			in.removeNode(opener.node)
+			in.removeDelim(opener)
+		}
+		if closer.n == 0 {
+			next := closer.next
+			in.removeNode(closer.node)
+			in.removeDelim(closer)
+			closer = next
+		}
+	}
+	for in.delims != bottom {
+		in.removeDelim(in.delims)
+	}
+}
+
+// emphasisPair reports whether opener can open the emphasis closer closes.
+func emphasisPair(opener, closer *mdDelim) bool {
+	if opener.c != closer.c || !opener.canOpen {
+		return false
+	}
+	// A run that could both open and close only pairs up with one whose
+	// length doesn't make the sum a multiple of three, so "*foo**bar*"
+	// stays one emphasis
+	if (opener.canClose || closer.canOpen) && (opener.orig+closer.orig)%3 == 0 &&
+		(opener.orig%3 != 0 || closer.orig%3 != 0) {
+		return false
+	}
+	return true
+}
+
+func (in *mdInline) pushBracket(start int, image bool) {
+	text := "["
+	if image {
+		text = "!["
+	}
+	in.seq++
+	in.brackets = &mdBracket{
+		node:   in.appendText(text),
+		image:  image,
+		start:  start,
+		seq:    in.seq,
+		delims: in.delims,
+		prev:   in.brackets,
+	}
+}
+
+// closeBracket handles the ] at s[i], turning the nearest bracket and
+// everything after it into a link or image if one is written there. It
+// returns where parsing resumes.
+func (in *mdInline) closeBracket(i int) int {
+	opener := in.brackets
+	if opener == nil {
+		in.appendText("]")
+		return i + 1
+	}
+	in.brackets = opener.prev
+	if !opener.image && opener.seq < in.lastLink {
+		in.appendText("]")
+		return i + 1
+	}
+	link, end, ok := in.linkAfter(opener.start, i)
+	if !ok {
+		in.appendText("]")
+		return i + 1
+	}
+
+	in.processEmphasis(opener.delims)
+	node := &mdNode{kind: mdLinkNode, link: link}
+	if opener.image {
+		node.kind = mdImage
+	}
+	if first := opener.node.next; first != nil {
+		node.first, node.last = first, in.root.last
+		first.prev = nil
+	}
+	node.prev = opener.node.prev
+	if node.prev != nil {
+		node.prev.next = node
+	} else {
+		in.root.first = node
+	}
+	in.root.last = node
+
+	if !opener.image {
+		in.lastLink = opener.seq
+	}
+	return end
+}
+
+// linkAfter parses what follows the link text s[start:close]: a (url
+// "title") destination, a [label] or [] reference, or nothing, for a
+// shortcut reference. It returns the link and where it ends.
+func (in *mdInline) linkAfter(start, close int) (mdLink, int, bool) {
+	s, rest := in.s, close+1
+	if rest < len(s) && s[rest] == '(' {
+		if link, end, ok := in.destination(rest); ok {
+			return link, end, true
+		}
+	}
+	if len(in.p.refs) == 0 {
+		return mdLink{}, 0, false
+	}
+	text := s[start:close]
+	if rest < len(s) && s[rest] == '[' {
+		if end := labelEnd(s, rest+1); end >= 0 {
+			label := s[rest+1 : end]
+			if label == "" {
+				label = text
+			}
+			if len(label) <= maxLinkLabel {
+				if link, ok := in.p.refs[normalizeLabel(label)]; ok {
+					return link, end + 1, true
+				}
+			}
+		}
+	}
+	if len(text) <= maxLinkLabel {
+		if link, ok := in.p.refs[normalizeLabel(text)]; ok {
+			return link, rest, true
+		}
+	}
+	return mdLink{}, 0, false
+}
+
+// labelEnd finds the ] ending the link label that starts at s[i], or -1.
+// Labels can't contain brackets or run past maxLinkLabel.
+func labelEnd(s string, i int) int {
+	for j := i; j < len(s) && j-i <= maxLinkLabel; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '[':
+			return -1
+		case ']':
+			return j
+		}
+	}
+	return -1
+}
+
+// destination parses (url "title") at s[i] and returns the link and where
+// it ends.
+func (in *mdInline) destination(i int) (mdLink, int, bool) {
+	s := in.s
+	i++
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	var link mdLink
+	if i < len(s) && s[i] == '<' {
+		end := strings.IndexAny(s[i+1:], "<>\n")
+		if end < 0 || s[i+1+end] != '>' {
+			return mdLink{}, 0, false
+		}
+		link.url = s[i+1 : i+1+end]
+		i += end + 2
+	} else {
+		start, depth := i, 0
+		for i < len(s) && s[i] != ' ' && s[i] != '\n' {
+			if s[i] == '(' {
+				if depth++; depth > maxDestinationParens {
+					return mdLink{}, 0, false
+				}
+			} else if s[i] == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+			i++
+		}
+		link.url = s[start:i]
+	}
+	for i < len(s) && (s[i] == ' ' || s[i] == '\n') {
+		i++
+	}
+	if i < len(s) && (s[i] == '"' || s[i] == '\'' || s[i] == '(') {
+		closer := s[i]
+		if closer == '(' {
+			closer = ')'
+		}
+		end := in.next(i+1, closer)
+		if end < 0 {
+			return mdLink{}, 0, false
+		}
+		link.title = s[i+1 : end]
+		i = end + 1
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+	}
+	if i >= len(s) || s[i] != ')' {
+		return mdLink{}, 0, false
+	}
+	return link, i + 1, true
+}
+
+// next returns the index of the first c at or after from, or -1. It
+// remembers the answer, so that repeated searches from positions that keep
+// moving forward take linear time in all.
+func (in *mdInline) next(from int, c byte) int {
+	if m, ok := in.found[c]; ok && from >= m[0] && (m[1] < 0 || from <= m[1]) {
+		return m[1]
+	}
+	at := strings.IndexByte(in.s[from:], c)
+	if at >= 0 {
+		at += from
+	}
+	if in.found == nil {
+		in.found = make(map[byte][2]int)
+	}
+	in.found[c] = [2]int{from, at}
+	return at
+}
+
+// writeInlines writes a list of nodes as HTML. Inside a link, autolinks
+// and bare URLs are written as plain text.
+func (p *mdParser) writeInlines(b *strings.Builder, n *mdNode, inLink bool) {
+	var text strings.Builder
+	for ; n != nil; n = n.next {
+		switch n.kind {
+		case mdText:
+			// Adjacent text is joined, so a bare URL split by delimiter
+			// characters is still found whole
+			text.Reset()
+			text.WriteString(n.text)
+			for n.next != nil && n.next.kind == mdText {
+				n = n.next
+				text.WriteString(n.text)
+			}
+			writeText(b, text.String(), inLink)
+		case mdHTML:
+			b.WriteString(n.html)
+		case mdAutolink:
+			if inLink {
+				b.WriteString(html.EscapeString(n.text))
+			} else {
+				b.WriteString(n.html)
+			}
+		case mdEm, mdStrong, mdDel:
+			tag := map[mdNodeKind]string{mdEm: "em", mdStrong: "strong", mdDel: "del"}[n.kind]
+			b.WriteString("<" + tag + ">")
+			p.writeInlines(b, n.first, inLink)
+			b.WriteString("</" + tag + ">")
+		case mdLinkNode:
+			b.WriteString(`<a href="` + html.EscapeString(safeURL(n.link.url)) + `"`)
+			if n.link.title != "" {
+				b.WriteString(` title="` + html.EscapeString(n.link.title) + `"`)
+			}
+			b.WriteString(` rel="nofollow noreferrer">`)
+			p.writeInlines(b, n.first, true)
+			b.WriteString("</a>")
+		case mdImage:
+			var alt strings.Builder
+			plainInlines(&alt, n.first)
+			b.WriteString(`<img src="` + html.EscapeString(safeURL(n.link.url)) + `" alt="` + html.EscapeString(alt.String()) + `"`)
+			if n.link.title != "" {
+				b.WriteString(` title="` + html.EscapeString(n.link.title) + `"`)
+			}
+			b.WriteString(` loading="lazy">`)
+		}
+	}
+}
+
+// plainInlines writes the text of a list of nodes without their markup,
+// for alt attributes.
+func plainInlines(b *strings.Builder, n *mdNode) {
+	for ; n != nil; n = n.next {
+		b.WriteString(n.text)
+		plainInlines(b, n.first)
+	}
+}
+
+// writeText escapes text, linking the bare URLs in it unless it is already
+// inside a link.
+func writeText(b *strings.Builder, s string, inLink bool) {
+	if inLink {
+		b.WriteString(html.EscapeString(s))
+		return
+	}
+	plain := 0
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c == 'h' || c == 'w') && (i == 0 || !isWordByte(s[i-1])) {
+			if end := bareURLEnd(s, i); end > i {
+				b.WriteString(html.EscapeString(s[plain:i]))
+				target := s[i:end]
+				href := target
+				if strings.HasPrefix(target, "www.") {
+					href = "https://" + target
+				}
+				b.WriteString(autolinkHTML(href, target))
+				i = end - 1
+				plain = end
+			}
+		}
+	}
+	b.WriteString(html.EscapeString(s[plain:]))
+}
+
+func autolinkHTML(href, text string) string {
+	return `<a href="` + html.EscapeString(safeURL(href)) + `" rel="nofollow noreferrer">` + html.EscapeString(text) + "</a>"
+}
+
+var mdEmail = regexp.MustCompile(`^[a-zA-Z0-9.!#$%&'*+/=?^_{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+func isAutolink(target string) bool {
+	if strings.ContainsAny(target, " <>\n") {
+		return false
+	}
+	lower := strings.ToLower(target)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "mailto:") || mdEmail.MatchString(target)
+}
+
+// bareURLEnd returns the end of a GFM extended autolink (http://, https://
+// or www.) starting at i, or i if there is none.
+func bareURLEnd(s string, i int) int {
+	rest := s[i:]
+	lower := strings.ToLower(rest[:min(len(rest), len("https://"))])
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "www.") {
+		return i
+	}
+	end := strings.IndexAny(rest, " \t\n<")
+	if end < 0 {
+		end = len(rest)
+	}
+	// Trailing punctuation belongs to the sentence, not the URL
+	open, closed := strings.Count(rest[:end], "("), strings.Count(rest[:end], ")")
+	for end > 0 {
+		last := rest[end-1]
+		if strings.IndexByte(".,:;!?\"'*_~", last) >= 0 {
+			end--
+			continue
+		}
+		if last == ')' && open < closed {
+			end--
+			closed--
+			continue
+		}
+		break
+	}
+	if end <= len("www.") {
+		return i
+	}
+	return i + end
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The renderer is the only thing between a paste and the clip origin, so
+// these tests check its output the way a browser would read it.
+
+var (
+	mdTag  = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)([^>]*)>`)
+	mdAttr = regexp.MustCompile(`^\s+([a-z-]+)(?:="([^"]*)")?`)
+
+	mdAllowedTags = map[string]bool{
+		"p": true, "em": true, "strong": true, "del": true, "code": true, "pre": true,
+		"a": true, "img": true, "br": true, "hr": true, "blockquote": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"ul": true, "ol": true, "li": true, "input": true, "span": true,
+		"table": true, "thead": true, "tbody": true, "tr": true, "th": true, "td": true,
+	}
+	mdAllowedAttrs = map[string]bool{
+		"href": true, "src": true, "alt": true, "title": true, "rel": true, "loading": true,
+		"class": true, "start": true, "type": true, "checked": true, "disabled": true,
+	}
+)
+
+// checkSafeHTML fails the test if out has a tag or attribute the renderer
+// never writes itself, or a link or image URL a browser would run.
+func checkSafeHTML(t *testing.T, src, out string) {
+	t.Helper()
+	for _, m := range mdTag.FindAllStringSubmatch(out, -1) {
+		if !mdAllowedTags[m[2]] {
+			t.Errorf("%q: rendered a <%s> tag: %q", src, m[2], out)
+			continue
+		}
+		attrs := m[3]
+		for attrs != "" {
+			a := mdAttr.FindStringSubmatch(attrs)
+			if a == nil {
+				t.Errorf("%q: unparseable attributes %q in %q", src, attrs, out)
+				break
+			}
+			attrs = attrs[len(a[0]):]
+			if !mdAllowedAttrs[a[1]] {
+				t.Errorf("%q: rendered a %s attribute: %q", src, a[1], out)
+			}
+			if (a[1] == "href" || a[1] == "src") && !safeScheme(a[2]) {
+				t.Errorf("%q: rendered an unsafe URL %q", src, a[2])
+			}
+		}
+	}
+}
+
+// safeScheme reports whether an attribute value, once a browser has decoded
+// it, is an http, https or mailto URL or has no scheme at all.
+func safeScheme(value string) bool {
+	u := html.UnescapeString(value)
+	// Browsers ignore tabs and newlines anywhere in a URL, and leading
+	// spaces and control characters
+	u = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(u)
+	u = strings.TrimLeft(u, "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x0b\x0c\x0e\x0f\x10\x11\x12\x13\x14\x15\x16\x17\x18\x19\x1a\x1b\x1c\x1d\x1e\x1f ")
+	i := strings.IndexAny(u, ":/?#")
+	if i < 0 || u[i] != ':' {
+		return true
+	}
+	switch strings.ToLower(u[:i]) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+func TestMarkdownEscapesRawHTML(t *testing.T) {
+	for _, tt := range []struct{ src, want string }{
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"a <img src=x onerror=alert(1)> b", "<p>a &lt;img src=x onerror=alert(1)&gt; b</p>\n"},
+		{"<div onclick=\"x\">\nhi\n</div>", "<p>&lt;div onclick=&#34;x&#34;&gt;\nhi\n&lt;/div&gt;</p>\n"},
+		{"`<b>` and \\<b>", "<p><code>&lt;b&gt;</code> and &lt;b&gt;</p>\n"},
+		{"```html\n<script>x</script>\n```", ""},
+		{"```\n<script>x</script>\n```", "<pre><code>&lt;script&gt;x&lt;/script&gt;</code></pre>\n"},
+		{"![<svg onload=alert(1)>](/x.png)", `<p><img src="/x.png" alt="&lt;svg onload=alert(1)&gt;" loading="lazy"></p>` + "\n"},
+		{`[a](/x 'b" onmouseover="alert(1)')`, `<p><a href="/x" title="b&#34; onmouseover=&#34;alert(1)" rel="nofollow noreferrer">a</a></p>` + "\n"},
+		{`[a](/x" onmouseover="alert(1))`, `<p>[a](/x&#34; onmouseover=&#34;alert(1))</p>` + "\n"},
+		{"| <b> | x |\n|---|---|\n| <i> | y |", ""},
+		{"> <iframe src=//evil>", ""},
+		{"- [ ] <style>*{}</style>", ""},
+		{"# <svg/onload=alert(1)>", ""},
+	} {
+		out := string(renderMarkdown(tt.src))
+		checkSafeHTML(t, tt.src, out)
+		if tt.want != "" && out != tt.want {
+			t.Errorf("%q:\ngot  %q\nwant %q", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestMarkdownURLSchemes(t *testing.T) {
+	for _, src := range []string{
+		"[a](javascript:alert(1))",
+		"[a](JaVaScRiPt:alert(1))",
+		"[a](  javascript:alert(1))",
+		"[a](<java\tscript:alert(1)>)",
+		"[a](<\x01javascript:alert(1)>)",
+		"[a](&#106;avascript:alert(1))",
+		"[a](&#x6A;avascript:alert(1))",
+		"[a](javascript&colon;alert(1))",
+		"[a](javascript&#58;alert(1))",
+		"[a](java\\script:alert(1))",
+		"[a](vbscript:msgbox)",
+		"[a](data:text/html;base64,PHNjcmlwdD4=)",
+		"[a](DATA:text/html,x)",
+		"[a][r]\n\n[r]: javascript:alert(1)",
+		"[r]\n\n[r]: <JavaScript:alert(1)> \"t\"",
+		"![a](javascript:alert(1))",
+		"![a](data:image/svg+xml,<svg/onload=alert(1)>)",
+		"![a][i]\n\n[i]: data:image/png;base64,AAAA",
+		"<javascript:alert(1)>",
+		"<JAVASCRIPT:alert(1)>",
+		"javascript:alert(1) and www.javascript:alert(1)",
+		"[*a*](javascript:alert(1) \"t\")",
+		"[a](file:///etc/passwd)",
+	} {
+		checkSafeHTML(t, src, string(renderMarkdown(src)))
+	}
+
+	// Allowed schemes and relative URLs are kept
+	for src, href := range map[string]string{
+		"[a](http://example.com/x)":  "http://example.com/x",
+		"[a](HTTPS://example.com/x)": "HTTPS://example.com/x",
+		"[a](mailto:me@example.com)": "mailto:me@example.com",
+		"[a](/x?a=1&b=2)":            "/x?a=1&amp;b=2",
+		"[a](#top)":                  "#top",
+		"[a](x/y:z)":                 "x/y:z",
+		"<https://example.com>":      "https://example.com",
+		"<me@example.com>":           "mailto:me@example.com",
+		"www.example.org":            "https://www.example.org",
+	} {
+		out := string(renderMarkdown(src))
+		if !strings.Contains(out, `href="`+href+`"`) {
+			t.Errorf("%q: want href %q in %q", src, href, out)
+		}
+	}
+}
+
+func TestMarkdownInlines(t *testing.T) {
+	for _, tt := range []struct{ src, want string }{
+		{"*a **b** c*", "<em>a <strong>b</strong> c</em>"},
+		{"***a***", "<em><strong>a</strong></em>"},
+		{"**a*", "*<em>a</em>"},
+		{"*a**", "<em>a</em>*"},
+		{"*a _b* c_", "<em>a _b</em> c_"},
+		{"snake_case_word", "snake_case_word"},
+		{"__a__b", "__a__b"},
+		{"~~a~~ ~b~", "<del>a</del> ~b~"},
+		{"\\*a\\*", "*a*"},
+		{"`*a*`", "<code>*a*</code>"},
+		{"*[a*](/x)", `*<a href="/x" rel="nofollow noreferrer">a*</a>`},
+		{"[*a*](/x)", `<a href="/x" rel="nofollow noreferrer"><em>a</em></a>`},
+		{"[[a]](/x)", `<a href="/x" rel="nofollow noreferrer">[a]</a>`},
+		// Links can't contain links, so the inner one wins
+		{"[a [b](/i) c](/o)", `[a <a href="/i" rel="nofollow noreferrer">b</a> c](/o)`},
+		{"![a [b](/l)](/i.png)", `<img src="/i.png" alt="a b" loading="lazy">`},
+		{"[a](</my url>)", `<a href="/my url" rel="nofollow noreferrer">a</a>`},
+		{"[a]", "[a]"},
+		{"[a](/x", "[a](/x"},
+		{"see https://example.com/a_(b). ok", `see <a href="https://example.com/a_(b)" rel="nofollow noreferrer">https://example.com/a_(b)</a>. ok`},
+	} {
+		want := "<p>" + tt.want + "</p>\n"
+		if got := string(renderMarkdown(tt.src)); got != want {
+			t.Errorf("%q:\ngot  %q\nwant %q", tt.src, got, want)
+		}
+	}
+}
+
+func TestMarkdownPathologicalInput(t *testing.T) {
+	// Each of these used to take seconds or recurse without bound; they
+	// must render, safely, in linear time
+	for _, src := range []string{
+		strings.Repeat("*a ", 20000),
+		strings.Repeat("[", 20000),
+		strings.Repeat("[a](b", 10000),
+		strings.Repeat("![", 10000),
+		strings.Repeat(">", 10000) + " a",
+		strings.Repeat("- ", 10000) + "a",
+		strings.Repeat("`a``", 10000),
+	} {
+		checkSafeHTML(t, src[:20], string(renderMarkdown(src)))
+	}
+}
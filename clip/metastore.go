@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Share metadata is kept durable in an append-only log beside a snapshot,
+// both in metaDir. Every change is one record holding a batch of puts and
+// deletes, written with a length and checksum and synced before the change
+// is acknowledged, so a batch survives a crash whole or not at all. Once the
+// log grows past snapshotThreshold the current state is written to a new
+// snapshot, swapped in by rename, and the log starts over.
+//
+// Recovery loads the snapshot and replays the log on top. A crash can only
+// tear the record being written, so replay stops at the first short or
+// corrupt record and the log is cut back to the last good one.
+//
+// Text bodies and uploads stay in uploads/; the store holds everything
+// else. Files are written before their share is recorded and removed after
+// it is deleted, so a crash can leave an orphaned file but never a share
+// without its content.
+
+const (
+	metaLogName      = "shares.log"
+	metaSnapshotName = "shares.snap"
+	metaLockName     = "lock"
+
+	snapshotThreshold = 4 << 20
+	// maxRecordSize bounds one record, so a corrupt length can't make
+	// recovery allocate wildly.
+	maxRecordSize = 64 << 20
+)
+
+// metaDir holds the store's files. It is kept apart from uploads/, where
+// a share's files live under its storage key; see blobPath.
+var metaDir = "meta"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errCorruptRecord = errors.New("corrupt record")
+	errStoreLocked   = errors.New("the metadata store is in use by another process, such as a running server")
+)
+
+// metaOp is one change in a batch: a share to store in full, new view
+// counts for shares already stored, or the ID of one to forget.
+type metaOp struct {
+	Put    *Share         `json:"put,omitempty"`
+	Views  map[string]int `json:"views,omitempty"`
+	Delete string         `json:"delete,omitempty"`
+}
+
+type metaStore struct {
+	mu      sync.Mutex
+	dir     string
+	log     *os.File
+	logSize int64
+	// lock is held for as long as the store is open
+	lock *os.File
+}
+
+// store is the server's metadata store, opened at startup.
+var store *metaStore
+
+// openMetaStore opens or creates the store in dir and returns the shares it
+// holds, repairing a log left torn by a crash.
+func openMetaStore(dir string) (*metaStore, map[string]Share, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	// A snapshot interrupted before its rename never took effect
+	os.Remove(filepath.Join(dir, metaSnapshotName+".tmp"))
+
+	lock, err := os.OpenFile(filepath.Join(dir, metaLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, nil, errStoreLocked
+	}
+
+	all := make(map[string]Share)
+	if err := readSnapshot(dir, all); err != nil {
+		lock.Close()
+		return nil, nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, metaLogName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		lock.Close()
+		return nil, nil, err
+	}
+	good, err := replay(log, all)
+	if err == nil {
+		_, err = log.Seek(good, io.SeekStart)
+	} else {
+		slog.Warn("Discarding torn tail of the metadata log", "offset", good, "err", err)
+		err = repairLog(log, good)
+	}
+	if err != nil {
+		log.Close()
+		lock.Close()
+		return nil, nil, err
+	}
+	return &metaStore{dir: dir, log: log, logSize: good, lock: lock}, all, nil
+}
+
+// repairLog cuts the log back to its last good record at offset good.
+func repairLog(log *os.File, good int64) error {
+	if err := log.Truncate(good); err != nil {
+		return err
+	}
+	if _, err := log.Seek(good, io.SeekStart); err != nil {
+		return err
+	}
+	return log.Sync()
+}
+
+// readSnapshot loads the snapshot in dir, if there is one, into all.
+func readSnapshot(dir string, all map[string]Share) error {
+	f, err := os.Open(filepath.Join(dir, metaSnapshotName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := replay(f, all); err != nil {
+		// Snapshots are complete before they're renamed into place, so
+		// this is damage rather than a crash
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	return nil
+}
+
+// readMetaStore loads the shares in dir without taking the lock or changing
+// anything, for commands that only look. It is safe while the server runs:
+// a record being written at that moment is skipped, not repaired.
+func readMetaStore(dir string) (map[string]Share, error) {
+	all := make(map[string]Share)
+	if err := readSnapshot(dir, all); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, metaLogName))
+	if os.IsNotExist(err) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	replay(f, all)
+	return all, nil
+}
+
+// replay applies the records read from r to all. It returns the offset just
+// past the last complete record, and an error if anything after it was
+// unreadable.
+func replay(r io.Reader, all map[string]Share) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	for {
+		payload, err := readRecord(br)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		var ops []metaOp
+		if err := json.Unmarshal(payload, &ops); err != nil {
+			return offset, fmt.Errorf("%w: %v", errCorruptRecord, err)
+		}
+		for _, op := range ops {
+			switch {
+			case op.Put != nil:
+				all[op.Put.ID] = *op.Put
+			case op.Views != nil:
+				for id, views := range op.Views {
+					if share, ok := all[id]; ok {
+						share.Views = views
+						all[id] = share
+					}
+				}
+			default:
+				delete(all, op.Delete)
+			}
+		}
+		offset += 8 + int64(len(payload))
+	}
+}
+
+// A record is the payload's length and CRC-32C, then the payload.
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: short header", errCorruptRecord)
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:4])
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("%w: length %d", errCorruptRecord, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: short payload", errCorruptRecord)
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+	return payload, nil
+}
+
+func appendRecord(buf []byte, ops []metaOp) ([]byte, error) {
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(payload, crcTable))
+	return append(buf, payload...), nil
+}
+
+// commit durably applies a batch of changes: all of them or, if it fails,
+// none.
+func (s *metaStore) commit(ops ...metaOp) error {
+	record, err := appendRecord(nil, ops)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.log.Write(record)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		// Don't leave half a record for the next one to follow
+		s.log.Truncate(s.logSize)
+		s.log.Seek(s.logSize, io.SeekStart)
+		return err
+	}
+	s.logSize += int64(len(record))
+	return nil
+}
+
+func (s *metaStore) put(share Share) error {
+	return s.commit(metaOp{Put: &share})
+}
+
+func (s *metaStore) delete(id string) error {
+	return s.commit(metaOp{Delete: id})
+}
+
+// needsSnapshot reports whether the log has grown enough to fold into a
+// new snapshot.
+func (s *metaStore) needsSnapshot() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logSize >= snapshotThreshold
+}
+
+// snapshot replaces the snapshot with all and empties the log. all must be
+// the store's complete current state, so the caller holds entriesMu.
+func (s *metaStore) snapshot(all map[string]Share) error {
+	var buf []byte
+	for _, share := range all {
+		var err error
+		if buf, err = appendRecord(buf, []metaOp{{Put: &share}}); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.dir, metaSnapshotName)
+	if err := writeSynced(path+".tmp", buf); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	// Replaying the old log over the new snapshot would be harmless, so a
+	// crash from here on loses nothing
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.logSize = 0
+	return s.log.Sync()
+}
+
+func (s *metaStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.log.Close()
+	s.lock.Close()
+	return err
+}
+
+// writeSynced writes data to a new file at path and syncs it to disk.
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
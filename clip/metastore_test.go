@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The tests here simulate crashes by damaging the store's files between
+// closing it and opening it again, then check what recovery makes of them.
+
+func testShare(id string) Share {
+	return Share{ID: id, Kind: KindText, Language: "go", Revisions: []Revision{{Language: "go"}}}
+}
+
+// openTestStore opens the store in dir, failing the test on error.
+func openTestStore(t *testing.T, dir string) (*metaStore, map[string]Share) {
+	t.Helper()
+	s, all, err := openMetaStore(dir)
+	if err != nil {
+		t.Fatalf("openMetaStore: %v", err)
+	}
+	return s, all
+}
+
+// putAll stores a share for each ID, one record apiece, and returns the log
+// size after each.
+func putAll(t *testing.T, s *metaStore, ids ...string) []int64 {
+	t.Helper()
+	var sizes []int64
+	for _, id := range ids {
+		if err := s.put(testShare(id)); err != nil {
+			t.Fatalf("put %s: %v", id, err)
+		}
+		sizes = append(sizes, s.logSize)
+	}
+	return sizes
+}
+
+func ids(all map[string]Share) string {
+	var list []string
+	for id := range all {
+		list = append(list, id)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func logPath(dir string) string {
+	return filepath.Join(dir, metaLogName)
+}
+
+func logSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(logPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// reopen opens the closed store in dir again, checking it recovered exactly
+// want and cut the log back to size.
+func reopen(t *testing.T, dir, want string, size int64) *metaStore {
+	t.Helper()
+	s, all := openTestStore(t, dir)
+	if got := ids(all); got != want {
+		t.Errorf("recovered shares %q, want %q", got, want)
+	}
+	if got := logSize(t, dir); got != size {
+		t.Errorf("log is %d bytes after recovery, want %d", got, size)
+	}
+	if s.logSize != size {
+		t.Errorf("store thinks the log is %d bytes, want %d", s.logSize, size)
+	}
+	return s
+}
+
+func TestMetaStoreTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestStore(t, dir)
+	sizes := putAll(t, s, "a", "b", "c")
+	s.close()
+
+	// The crash came partway through writing c
+	if err := os.Truncate(logPath(dir), sizes[2]-5); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, dir, "a,b", sizes[1])
+
+	// Writing carries on from the last good record
+	putAll(t, s, "d")
+	s.close()
+	s = reopen(t, dir, "a,b,d", s.logSize)
+	s.close()
+}
+
+func TestMetaStoreGarbageTail(t *testing.T) {
+	for name, garbage := range map[string][]byte{
+		"zeros":  make([]byte, 100),
+		"random": []byte("\x13\x00\x00\x00\xde\xad\xbe\xefnot a record at all"),
+		"huge":   {0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, _ := openTestStore(t, dir)
+			sizes := putAll(t, s, "a", "b")
+			s.close()
+
+			// The file grew but the record's bytes never reached it
+			f, err := os.OpenFile(logPath(dir), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(garbage)
+			f.Close()
+
+			s = reopen(t, dir, "a,b", sizes[1])
+			s.close()
+		})
+	}
+}
+
+func TestMetaStoreCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestStore(t, dir)
+	sizes := putAll(t, s, "a", "b", "c")
+	s.close()
+
+	// Damage b's payload; its length still reads fine, so only the
+	// checksum catches it
+	data, err := os.ReadFile(logPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := sizes[0] + 8 + int64(bytes.Index(data[sizes[0]+8:], []byte(`"b"`))) + 1
+	data[i] = 'x'
+	if err := os.WriteFile(logPath(dir), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing after a bad record can be trusted, so c goes with it
+	s = reopen(t, dir, "a", sizes[0])
+	s.close()
+}
+
+func TestMetaStoreCrashDuringSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestStore(t, dir)
+	putAll(t, s, "a", "b", "c")
+	if err := s.delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	views := testShare("c")
+	views.Views = 7
+	if err := s.put(views); err != nil {
+		t.Fatal(err)
+	}
+	oldLog, err := os.ReadFile(logPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := map[string]Share{"a": testShare("a"), "c": views}
+	if err := s.snapshot(all); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// The new snapshot was renamed into place, but the crash came before
+	// the log was emptied: replaying it over the snapshot must change
+	// nothing
+	if err := os.WriteFile(logPath(dir), oldLog, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// and a later snapshot was cut short before its rename
+	tmp := filepath.Join(dir, metaSnapshotName+".tmp")
+	if err := os.WriteFile(tmp, []byte("half a snap"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, got := openTestStore(t, dir)
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("unfinished snapshot was left behind: %v", err)
+	}
+	if ids(got) != "a,c" {
+		t.Errorf("recovered shares %q, want %q", ids(got), "a,c")
+	}
+	if got["c"].Views != 7 {
+		t.Errorf("c has %d views, want 7", got["c"].Views)
+	}
+	if s.logSize != int64(len(oldLog)) {
+		t.Errorf("log is %d bytes, want the old log's %d", s.logSize, len(oldLog))
+	}
+
+	// The next snapshot takes over as usual
+	putAll(t, s, "d")
+	if err := s.snapshot(map[string]Share{"a": testShare("a"), "c": views, "d": testShare("d")}); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	s = reopen(t, dir, "a,c,d", 0)
+	s.close()
+}
+
+func TestMetaStoreViews(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestStore(t, dir)
+	putAll(t, s, "a")
+	if err := s.commit(metaOp{Views: map[string]int{"a": 3, "gone": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	s, all := openTestStore(t, dir)
+	defer s.close()
+	if ids(all) != "a" || all["a"].Views != 3 {
+		t.Errorf("recovered %q with %d views, want a with 3", ids(all), all["a"].Views)
+	}
+}
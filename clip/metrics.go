@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny Prometheus text-format exposition, so /metrics doesn't pull in
+// client_golang.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry []metric
+
+// counterVec is a set of counters keyed by label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	registry = append(registry, c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, values), formatValue(c.values[k]))
+	}
+}
+
+// gaugeFunc is a gauge computed at scrape time. collect returns one value
+// per label combination.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func() map[string]float64
+}
+
+func newGaugeFunc(name, help string, labels []string, collect func() map[string]float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	registry = append(registry, g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	values := g.collect()
+	writeHeader(w, g.name, g.help, "gauge")
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var labelValues []string
+		if len(g.labels) > 0 {
+			labelValues = strings.Split(k, "\xff")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, labelValues), formatValue(values[k]))
+	}
+}
+
+// histogram tracks observations in fixed cumulative buckets.
+type histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	registry = append(registry, h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// exponentialBuckets returns count upper bounds starting at start and
+// growing by factor.
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+var (
+	sharesCreated = newCounter("clip_shares_created_total", "Shares created, by type.", "type")
+	sharesViewed  = newCounter("clip_shares_viewed_total", "Shares viewed or downloaded, by type.", "type")
+	sharesDeleted = newCounter("clip_shares_deleted_total", "Shares deleted by their users, by type.", "type")
+	sharesEdited  = newCounter("clip_shares_edited_total", "Revisions saved by editing text shares.")
+	padOps        = newCounter("clip_pad_operations_total", "Edits applied to live scratchpads.")
+
+	uploadBytes    = newHistogram("clip_upload_bytes", "Size of uploaded files.", exponentialBuckets(1<<10, 4, 11))
+	uploadDuration = newHistogram("clip_upload_duration_seconds", "Time taken to receive and store an uploaded file.", exponentialBuckets(0.01, 4, 10))
+
+	cleanupRuns    = newCounter("clip_cleanup_runs_total", "Cleanup runs performed.")
+	cleanupExpired = newCounter("clip_cleanup_expired_total", "Shares removed by cleanup after expiring, by type.", "type")
+
+	httpRequests = newCounter("clip_http_requests_total", "HTTP responses, by route and status code.", "route", "code")
+
+	_ = newGaugeFunc("clip_active_shares", "Shares currently stored, by type.", []string{"type"}, func() map[string]float64 {
+		entriesMu.Lock()
+		defer entriesMu.Unlock()
+		counts := map[string]float64{
+			string(KindText):   0,
+			string(KindFile):   0,
+			string(KindBundle): 0,
+			"room":             float64(len(rooms)),
+		}
+		for _, s := range shares {
+			counts[string(s.Kind)]++
+		}
+		return counts
+	})
+	_ = newGaugeFunc("clip_event_streams", "Open server-sent event streams.", nil, func() map[string]float64 {
+		return map[string]float64{"": float64(openStreams.Load())}
+	})
+	_ = newGaugeFunc("clip_storage_bytes", "Bytes stored on disk under uploads/.", nil, func() map[string]float64 {
+		return map[string]float64{"": float64(storageUsed.Load())}
+	})
+)
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+// statusRecorder captures the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		if s.status == 0 {
+			s.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// instrument assigns a request ID, then counts and access-logs responses
+// for the route registered under pattern.
+func instrument(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = withRequestID(w, r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.inc(pattern, strconv.Itoa(rec.status))
+		accessLog(pattern, r, rec, start)
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"unicode/utf16"
+)
+
+// Operational transformation for live scratchpads, following ot.js. An
+// operation walks the whole document: it retains, deletes or inserts text.
+// On the wire it is a JSON array where positive numbers retain, negative
+// numbers delete and strings insert. Lengths count UTF-16 code units, as
+// JavaScript strings do, so browser and server agree on positions.
+
+type opComponent struct {
+	n int    // > 0 retains n units, < 0 deletes -n units
+	s string // inserts s when n == 0
+}
+
+type textOp []opComponent
+
+var errBadOp = errors.New("malformed operation")
+
+func (op *textOp) UnmarshalJSON(data []byte) error {
+	var raw []any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	// Retains and deletes walk the document, so together they can't cover
+	// more than a pad can hold; bounding them also keeps the sums from
+	// overflowing
+	var out textOp
+	base := 0
+	for _, c := range raw {
+		switch v := c.(type) {
+		case float64:
+			if v != math.Trunc(v) || v == 0 || math.Abs(v) > maxPadLength {
+				return errBadOp
+			}
+			n := int(v)
+			if base += max(n, -n); base > maxPadLength {
+				return errBadOp
+			}
+			if n > 0 {
+				out.retain(n)
+			} else {
+				out.delete(-n)
+			}
+		case string:
+			if v == "" {
+				return errBadOp
+			}
+			out.insert(v)
+		default:
+			return errBadOp
+		}
+	}
+	*op = out
+	return nil
+}
+
+func (op textOp) MarshalJSON() ([]byte, error) {
+	raw := make([]any, len(op))
+	for i, c := range op {
+		if c.n != 0 {
+			raw[i] = c.n
+		} else {
+			raw[i] = c.s
+		}
+	}
+	return json.Marshal(raw)
+}
+
+func (op *textOp) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].n > 0 {
+		(*op)[last].n += n
+		return
+	}
+	*op = append(*op, opComponent{n: n})
+}
+
+func (op *textOp) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].n < 0 {
+		(*op)[last].n -= n
+		return
+	}
+	*op = append(*op, opComponent{n: -n})
+}
+
+func (op *textOp) insert(s string) {
+	if s == "" {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].n == 0 {
+		(*op)[last].s += s
+		return
+	}
+	*op = append(*op, opComponent{s: s})
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// baseLen is the length of document op applies to.
+func (op textOp) baseLen() int {
+	n := 0
+	for _, c := range op {
+		if c.n > 0 {
+			n += c.n
+		} else {
+			n -= c.n
+		}
+	}
+	return n
+}
+
+// apply returns doc with op applied.
+func (op textOp) apply(doc []uint16) ([]uint16, error) {
+	if op.baseLen() != len(doc) {
+		return nil, errBadOp
+	}
+	out := make([]uint16, 0, len(doc))
+	pos := 0
+	for _, c := range op {
+		switch {
+		case c.n > 0:
+			if c.n > len(doc)-pos {
+				return nil, errBadOp
+			}
+			out = append(out, doc[pos:pos+c.n]...)
+			pos += c.n
+		case c.n < 0:
+			if -c.n > len(doc)-pos {
+				return nil, errBadOp
+			}
+			pos -= c.n
+		default:
+			out = append(out, utf16.Encode([]rune(c.s))...)
+		}
+	}
+	if pos != len(doc) {
+		return nil, errBadOp
+	}
+	return out, nil
+}
+
+// transform takes concurrent operations a and b on the same document and
+// returns a' and b' such that applying a then b' gives the same result as
+// b then a'. At the same position a's insertion goes first.
+func transform(a, b textOp) (textOp, textOp, error) {
+	if a.baseLen() != b.baseLen() {
+		return nil, nil, errBadOp
+	}
+	var a1, b1 textOp
+	i, j := 0, 0
+	var ca, cb opComponent
+	next := func(op textOp, k *int) opComponent {
+		if *k >= len(op) {
+			return opComponent{}
+		}
+		c := op[*k]
+		*k++
+		return c
+	}
+	ca, cb = next(a, &i), next(b, &j)
+	isNone := func(c opComponent) bool { return c.n == 0 && c.s == "" }
+
+	for !isNone(ca) || !isNone(cb) {
+		if ca.n == 0 && ca.s != "" {
+			a1.insert(ca.s)
+			b1.retain(utf16Len(ca.s))
+			ca = next(a, &i)
+			continue
+		}
+		if cb.n == 0 && cb.s != "" {
+			a1.retain(utf16Len(cb.s))
+			b1.insert(cb.s)
+			cb = next(b, &j)
+			continue
+		}
+		if isNone(ca) || isNone(cb) {
+			return nil, nil, errBadOp
+		}
+
+		la, lb := ca.n, cb.n
+		if la < 0 {
+			la = -la
+		}
+		if lb < 0 {
+			lb = -lb
+		}
+		m := min(la, lb)
+		switch {
+		case ca.n > 0 && cb.n > 0:
+			a1.retain(m)
+			b1.retain(m)
+		case ca.n < 0 && cb.n > 0:
+			a1.delete(m)
+		case ca.n > 0 && cb.n < 0:
+			b1.delete(m)
+		}
+		// Both deleting the same text: nothing left for either to do
+
+		ca = shorten(ca, m)
+		cb = shorten(cb, m)
+		if isNone(ca) {
+			ca = next(a, &i)
+		}
+		if isNone(cb) {
+			cb = next(b, &j)
+		}
+	}
+	return a1, b1, nil
+}
+
+// shorten consumes m units from a retain or delete component.
+func shorten(c opComponent, m int) opComponent {
+	if c.n > 0 {
+		c.n -= m
+	} else {
+		c.n += m
+	}
+	return c
+}
+
+// transformIndex moves a cursor position through op.
+func transformIndex(pos int, op textOp) int {
+	newPos, i := pos, 0
+	for _, c := range op {
+		if i > pos {
+			break
+		}
+		switch {
+		case c.n > 0:
+			i += c.n
+		case c.n < 0:
+			newPos -= min(pos-i, -c.n)
+			i -= c.n
+		default:
+			newPos += utf16Len(c.s)
+		}
+	}
+	return newPos
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// overflowingOp sums to a base length of zero once its retains wrap around.
+const overflowingOp = `[9223372036854773760,"x",9223372036854773760,"y",4096]`
+
+func TestTextOpRejectsOversizedLengths(t *testing.T) {
+	for _, data := range []string{
+		overflowingOp,
+		`[1048577]`,
+		`[-1048577]`,
+		`[1048576,-1]`,
+		`[0]`,
+		`[1.5]`,
+		`[""]`,
+		`[null]`,
+	} {
+		var op textOp
+		if err := json.Unmarshal([]byte(data), &op); err == nil {
+			t.Errorf("%s: accepted as %v", data, op)
+		}
+	}
+
+	var op textOp
+	if err := json.Unmarshal([]byte(`[2,"ab",-1,1048573]`), &op); err != nil {
+		t.Errorf("valid operation rejected: %v", err)
+	}
+}
+
+func TestTextOpApplyChecksBounds(t *testing.T) {
+	doc := utf16.Encode([]rune("hello"))
+	for _, op := range []textOp{
+		{{n: 6}},
+		{{n: 3}, {n: -3}},
+		{{n: 2}},
+		// Lengths that add up to the document only once they overflow
+		{{n: 1 << 62}, {n: 1 << 62}, {n: 1 << 62}, {n: 1 << 62}, {n: 5}},
+	} {
+		if out, err := op.apply(doc); err == nil {
+			t.Errorf("%v applied to %q gave %q", op, "hello", string(utf16.Decode(out)))
+		}
+	}
+}
+
+func TestPadRejectsOverflowingOp(t *testing.T) {
+	const id = "overflow-pad"
+	entriesMu.Lock()
+	shares[id] = Share{ID: id, Kind: KindText, Flags: FlagLive, ExpiresAt: time.Now().Add(time.Hour), Revisions: []Revision{{}}}
+	entriesMu.Unlock()
+	p := livePad(id)
+	p.clients["client-1"] = &padClient{ID: "client-1"}
+	defer func() {
+		closePad(id)
+		entriesMu.Lock()
+		delete(shares, id)
+		entriesMu.Unlock()
+	}()
+
+	body := `{"client":"client-1","rev":0,"op":` + overflowingOp + `}`
+	w := httptest.NewRecorder()
+	padOpHandler(w, httptest.NewRequest("POST", "/c/"+id+"/ops", strings.NewReader(body)), id)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if len(p.doc) != 0 || p.rev != 0 {
+		t.Errorf("pad changed to %q at rev %d", string(utf16.Decode(p.doc)), p.rev)
+	}
+}
+
+// op builds an operation from retains (positive), deletes (negative) and
+// inserts (strings).
+func op(parts ...any) textOp {
+	var o textOp
+	for _, p := range parts {
+		switch p := p.(type) {
+		case int:
+			if p > 0 {
+				o.retain(p)
+			} else {
+				o.delete(-p)
+			}
+		case string:
+			o.insert(p)
+		}
+	}
+	return o
+}
+
+func TestTransformConverges(t *testing.T) {
+	doc := utf16.Encode([]rune("hello world"))
+	for _, tt := range []struct {
+		name string
+		a, b textOp
+		want string
+	}{
+		{"inserts apart", op("> ", 11), op(11, "!"), "> hello world!"},
+		{"inserts at the same spot", op(5, ",", 6), op(5, ";", 6), "hello,; world"},
+		{"insert inside a delete", op(5, -6), op(8, "XX", 3), "helloXX"},
+		{"overlapping deletes", op(2, -5, 4), op(4, -5, 2), "held"},
+		{"same delete", op(5, -6), op(5, -6), "hello"},
+		{"delete and retain everything", op(-11), op(11), ""},
+		{"surrogate pairs", op(6, "🙂", 5), op(6, -5, "🌍"), "hello 🙂🌍"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a1, b1, err := transform(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var results []string
+			for _, path := range [][2]textOp{{tt.a, b1}, {tt.b, a1}} {
+				out, err := path[0].apply(doc)
+				if err == nil {
+					out, err = path[1].apply(out)
+				}
+				if err != nil {
+					t.Fatalf("applying %v then %v: %v", path[0], path[1], err)
+				}
+				results = append(results, string(utf16.Decode(out)))
+			}
+			if results[0] != tt.want || results[1] != tt.want {
+				t.Errorf("a then b' gave %q, b then a' gave %q, want %q", results[0], results[1], tt.want)
+			}
+		})
+	}
+
+	if _, _, err := transform(op(5), op(6)); err == nil {
+		t.Error("transformed operations on documents of different lengths")
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	edit := op(2, "abc", -3, 6) // on "hello world": "heabc world"
+	for pos, want := range map[int]int{0: 0, 2: 5, 4: 5, 5: 5, 8: 8, 11: 11} {
+		if got := transformIndex(pos, edit); got != want {
+			t.Errorf("cursor at %d moved to %d, want %d", pos, got, want)
+		}
+	}
+}
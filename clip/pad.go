@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// Live scratchpads are text shares that everyone with the link can edit at
+// once. The server holds the authoritative document and a short history of
+// operations; clients send operations against the revision they last saw,
+// and the server transforms them against anything applied since. Applied
+// operations and presence go out to every editor over server-sent events.
+// The document is saved back to its Share shortly after each
+// change, so it persists and expires like any other text share.
+
+const (
+	maxPadLength  = 1 << 20 // UTF-16 units
+	padHistoryLen = 500     // operations kept for transforming late clients
+	padSaveDelay  = 2 * time.Second
+)
+
+type pad struct {
+	id string
+
+	mu          sync.Mutex
+	doc         []uint16
+	rev         int
+	history     []textOp // operations that produced revisions historyBase+1 onwards
+	historyBase int
+	clients     map[string]*padClient
+	hub         hub
+	dirty       bool
+	saveTimer   *time.Timer
+	closed      bool
+}
+
+// padClient is one editor, possibly with several open connections.
+type padClient struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Color  string `json:"color"`
+	Line   int    `json:"line"`
+	cursor int
+	conns  int
+}
+
+var (
+	padsMu sync.Mutex
+	pads   = make(map[string]*pad)
+
+	padColors = []string{"#e74c3c", "#3498db", "#27ae60", "#8e44ad", "#e67e22", "#16a085", "#d35400", "#2c3e50"}
+	clientIDs = regexp.MustCompile(`^[a-zA-Z0-9-]{8,64}$`)
+)
+
+// livePad returns the pad for a live text share, loading it from the entry
+// on first use, or nil if id isn't a live share.
+func livePad(id string) *pad {
+	entriesMu.Lock()
+	entry, exists := findShare(KindText, id)
+	entriesMu.Unlock()
+	if !exists || !entry.Live() {
+		return nil
+	}
+
+	padsMu.Lock()
+	defer padsMu.Unlock()
+	p := pads[id]
+	if p == nil {
+		p = &pad{
+			id:      id,
+			doc:     utf16.Encode([]rune(entry.Content)),
+			clients: make(map[string]*padClient),
+		}
+		pads[id] = p
+	}
+	return p
+}
+
+// closePad disconnects everyone from a pad that was finished, deleted or
+// expired.
+func closePad(id string) {
+	padsMu.Lock()
+	p := pads[id]
+	delete(pads, id)
+	padsMu.Unlock()
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.saveTimer != nil {
+		p.saveTimer.Stop()
+	}
+	p.hub.publish(newEvent("closed", nil))
+	p.hub.close()
+}
+
+// text returns the current document and marks it saved.
+func (p *pad) text() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty = false
+	return string(utf16.Decode(p.doc))
+}
+
+// save writes the document back to its text share.
+func (p *pad) save() {
+	p.mu.Lock()
+	dirty := p.dirty
+	p.saveTimer = nil
+	p.mu.Unlock()
+	if dirty {
+		savePadContent(p.id, p.text())
+	}
+}
+
+// scheduleSave saves the pad after a quiet moment. Called with p.mu held.
+func (p *pad) scheduleSave() {
+	p.dirty = true
+	if p.saveTimer == nil {
+		p.saveTimer = time.AfterFunc(padSaveDelay, p.save)
+	}
+}
+
+// savePadContent stores content as the current revision of a live share.
+func savePadContent(id, content string) {
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+	entry, exists := findShare(KindText, id)
+	if !exists || !entry.Live() {
+		return
+	}
+	n := len(entry.Revisions)
+	if err := replaceUpload(revisionPath(entry.Key, n), []byte(content)); err != nil {
+		slog.Error("Failed to save scratchpad", "id", id, "err", err)
+	}
+	entry.setContent(content)
+	// Copies of the share handed out by getShare are read without the lock,
+	// so the revisions they point at must never change in place
+	entry.Revisions = append([]Revision(nil), entry.Revisions...)
+	entry.Revisions[n-1].Content = content
+	entry.Revisions[n-1].SavedAt = time.Now()
+	putShare(entry)
+}
+
+// presence lists who is connected and where their cursor is. Called with
+// p.mu held.
+func (p *pad) presence() []*padClient {
+	list := make([]*padClient, 0, len(p.clients))
+	for _, c := range p.clients {
+		c.Line = 1
+		for _, u := range p.doc[:min(c.cursor, len(p.doc))] {
+			if u == '\n' {
+				c.Line++
+			}
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func padColor(clientID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(clientID))
+	return padColors[h.Sum32()%uint32(len(padColors))]
+}
+
+// padEventsHandler streams a pad to one editor: a snapshot first, then
+// every applied operation and presence change.
+func padEventsHandler(w http.ResponseWriter, r *http.Request, id string) {
+	p := livePad(id)
+	if p == nil {
+		http.Error(w, "Scratchpad not found or expired", http.StatusNotFound)
+		return
+	}
+	clientID := r.URL.Query().Get("client")
+	if !clientIDs.MatchString(clientID) {
+		http.Error(w, "Invalid client ID", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		http.Error(w, "Scratchpad is closed", http.StatusGone)
+		return
+	}
+	c := p.clients[clientID]
+	if c == nil {
+		c = &padClient{ID: clientID, Name: generateReadableID(), Color: padColor(clientID)}
+		p.clients[clientID] = c
+	}
+	c.conns++
+	ch := p.hub.subscribe()
+	snapshot := newEvent("snapshot", map[string]any{
+		"rev":  p.rev,
+		"text": string(utf16.Decode(p.doc)),
+		"you":  c,
+	})
+	p.hub.publish(newEvent("presence", p.presence()))
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		c.conns--
+		if c.conns == 0 {
+			delete(p.clients, clientID)
+		}
+		empty := len(p.clients) == 0
+		p.hub.unsubscribe(ch)
+		p.hub.publish(newEvent("presence", p.presence()))
+		p.mu.Unlock()
+		// Save straight away once the last editor leaves
+		if empty {
+			p.save()
+		}
+	}()
+
+	serveEvents(w, r, ch, snapshot)
+}
+
+type padMessage struct {
+	Client string `json:"client"`
+	Rev    int    `json:"rev"`
+	Op     textOp `json:"op"`
+	Cursor *int   `json:"cursor"`
+}
+
+// padOpHandler applies an editor's operation and/or cursor move. The
+// operation is acknowledged through the event stream, in order with
+// everyone else's, rather than in the response.
+func padOpHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := livePad(id)
+	if p == nil {
+		http.Error(w, "Scratchpad not found or expired", http.StatusNotFound)
+		return
+	}
+
+	var msg padMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<20)).Decode(&msg); err != nil {
+		http.Error(w, "Invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		http.Error(w, "Scratchpad is closed", http.StatusGone)
+		return
+	}
+	c := p.clients[msg.Client]
+	if c == nil {
+		http.Error(w, "Not connected", http.StatusConflict)
+		return
+	}
+
+	if msg.Op != nil {
+		if msg.Rev < p.historyBase || msg.Rev > p.rev {
+			http.Error(w, "Out of date, reload the scratchpad", http.StatusConflict)
+			return
+		}
+		op := msg.Op
+		for _, applied := range p.history[msg.Rev-p.historyBase:] {
+			var err error
+			if op, _, err = transform(op, applied); err != nil {
+				http.Error(w, "Operation doesn't match the document", http.StatusBadRequest)
+				return
+			}
+		}
+		doc, err := op.apply(p.doc)
+		if err != nil {
+			http.Error(w, "Operation doesn't match the document", http.StatusBadRequest)
+			return
+		}
+		if len(doc) > maxPadLength {
+			http.Error(w, "Scratchpad is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if grow := len(doc) - len(p.doc); grow > 0 {
+			if err := checkCapacity(int64(grow)); err != nil {
+				rejectStorageFull(w)
+				return
+			}
+		}
+
+		p.doc = doc
+		p.rev++
+		p.history = append(p.history, op)
+		if drop := len(p.history) - padHistoryLen; drop > 0 {
+			p.history = append([]textOp(nil), p.history[drop:]...)
+			p.historyBase += drop
+		}
+		for _, other := range p.clients {
+			if other != c {
+				other.cursor = transformIndex(other.cursor, op)
+			}
+		}
+		padOps.inc()
+		p.scheduleSave()
+		p.hub.publish(newEvent("op", map[string]any{"rev": p.rev, "client": c.ID, "op": op}))
+	}
+
+	if msg.Cursor != nil {
+		c.cursor = max(0, min(*msg.Cursor, len(p.doc)))
+	}
+	p.hub.publish(newEvent("presence", p.presence()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishPadHandler ends a live session: the share becomes an ordinary text
+// share with the pad's final content. Only its owner may finish it.
+func finishPadHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entriesMu.Lock()
+	entry, exists := findShare(KindText, id)
+	entriesMu.Unlock()
+	if !exists || !entry.Live() {
+		http.Error(w, "Scratchpad not found or expired", http.StatusNotFound)
+		return
+	}
+	if !canManage(r, id, entry.ManageTokenHash) {
+		http.Error(w, "Finishing requires this share's manage token", http.StatusForbidden)
+		return
+	}
+
+	if p := livePad(id); p != nil {
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+		savePadContent(id, p.text())
+	}
+
+	entriesMu.Lock()
+	entry, exists = findShare(KindText, id)
+	if exists {
+		entry.Flags &^= FlagLive
+		if entry.Language == "" {
+			entry.Language = detectLanguage(entry.Content)
+			entry.Revisions = append([]Revision(nil), entry.Revisions...)
+			entry.Revisions[len(entry.Revisions)-1].Language = entry.Language
+		}
+		putShare(entry)
+	}
+	entriesMu.Unlock()
+	closePad(id)
+	if !exists {
+		http.Error(w, "Scratchpad not found or expired", http.StatusNotFound)
+		return
+	}
+
+	audit(r, "finished", "text", id, "bytes", len(entry.Content))
+	http.Redirect(w, r, "/c/"+id, http.StatusSeeOther)
+}
+
+// padPage renders the editor for a live share.
+func padPage(w http.ResponseWriter, r *http.Request, entry Share) {
+	renewManageCookies(w, r, entry)
+	render(w, "pad.html", struct {
+		ID        string
+		URL       string
+		TimeLeft  string
+		CanFinish bool
+		CSRFToken string
+	}{
+		ID:        entry.ID,
+		URL:       r.Host + r.URL.Path,
+		TimeLeft:  formatDuration(time.Until(entry.ExpiresAt)),
+		CanFinish: canManage(r, entry.ID, entry.ManageTokenHash),
+		CSRFToken: csrfToken(w, r),
+	})
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+)
+
+// QR codes for share links, so a phone can open a share by pointing its
+// camera at the screen. The encoder follows ISO/IEC 18004: byte mode at
+// error correction level M, the smallest version that fits, and whichever
+// of the eight masks scores best.
+
+// Per version (index 1 to 40), level M's error correction codewords per
+// block and number of blocks.
+var (
+	qrECCPerBlock = [41]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrECCBlocks   = [41]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+var errQRTooLong = errors.New("too long for a QR code")
+
+type qrCode struct {
+	size     int
+	dark     [][]bool
+	function [][]bool // finder, timing, alignment, format and version modules
+}
+
+// encodeQR makes a QR code holding data.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 1
+	for ; version <= 40; version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= qrDataCodewords(version)*8 && len(data) < 1<<countBits {
+			break
+		}
+	}
+	if version > 40 {
+		return nil, errQRTooLong
+	}
+
+	// Byte mode segment, terminator and padding
+	var bits qrBits
+	bits.append(0b0100, 4)
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	q := &qrCode{size: version*4 + 17}
+	q.dark = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.dark {
+		q.dark[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrAddECC(codewords, version))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // XOR again to undo
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>i&1 != 0)
+	}
+}
+
+// qrRawModules is how many modules of a version carry data and error
+// correction, once the function patterns are in place.
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrECCBlocks[version]
+}
+
+// qrAddECC splits data into blocks, adds Reed-Solomon error correction to
+// each and interleaves the result.
+func qrAddECC(data []byte, version int) []byte {
+	numBlocks, eccLen := qrECCBlocks[version], qrECCPerBlock[version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	var blocks [][]byte
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(block, divisor)
+		// Short blocks get a gap so all blocks line up when interleaving
+		if i < numShort {
+			block = append(block, 0)
+		}
+		blocks = append(blocks, append(block, ecc...))
+	}
+
+	var out []byte
+	for i := 0; i < len(blocks[0]); i++ {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+// rsMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func rsMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11d
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = rsMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = rsMultiply(root, 2)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= rsMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.dark[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	// Timing patterns
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, with their separators
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					dist := max(abs(dx), abs(dy))
+					q.set(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns, except where they'd overlap the finders
+	pos := qrAlignmentPositions(version, q.size)
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format area; the real bits go in once the mask is chosen
+	q.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 != 0
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+func qrAlignmentPositions(version, size int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, size-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// drawFormatBits writes level M and the mask, twice.
+func (q *qrCode) drawFormatBits(mask int) {
+	data := 0<<3 | mask // level M is 0b00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true) // always dark
+}
+
+// drawCodewords fills the data area in the standard zigzag, two columns at
+// a time from the bottom right.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // upwards
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.dark[y][x] = data[i>>3]>>(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.dark[y][x] = !q.dark[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code would be to scan, by the standard's
+// four rules: long runs, 2×2 blocks, finder-like patterns and an uneven
+// balance of dark and light.
+func (q *qrCode) penalty() int {
+	p := 0
+	finderLike := func(line []bool) int {
+		n := 0
+		for i := 0; i+11 <= len(line); i++ {
+			pattern := "10111010000"
+			a, b := true, true
+			for k := 0; k < 11; k++ {
+				if line[i+k] != (pattern[k] == '1') {
+					a = false
+				}
+				if line[i+k] != (pattern[10-k] == '1') {
+					b = false
+				}
+			}
+			if a {
+				n++
+			}
+			if b {
+				n++
+			}
+		}
+		return n
+	}
+	runs := func(line []bool) int {
+		n, run := 0, 1
+		for i := 1; i <= len(line); i++ {
+			if i < len(line) && line[i] == line[i-1] {
+				run++
+				continue
+			}
+			if run >= 5 {
+				n += run - 2
+			}
+			run = 1
+		}
+		return n
+	}
+
+	darkCount := 0
+	column := make([]bool, q.size)
+	for i := 0; i < q.size; i++ {
+		for j := 0; j < q.size; j++ {
+			column[j] = q.dark[j][i]
+		}
+		p += runs(q.dark[i]) + runs(column)
+		p += 40 * (finderLike(q.dark[i]) + finderLike(column))
+		for j := 0; j < q.size; j++ {
+			if q.dark[i][j] {
+				darkCount++
+			}
+			if i+1 < q.size && j+1 < q.size {
+				c := q.dark[i][j]
+				if q.dark[i][j+1] == c && q.dark[i+1][j] == c && q.dark[i+1][j+1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	k := (abs(darkCount*20-total*10) + total - 1) / total
+	return p + (k-1)*10
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// qrQuietZone is the light border scanners need around a code.
+const qrQuietZone = 4
+
+// png renders the code with scale pixels per module.
+func (q *qrCode) png(scale int) ([]byte, error) {
+	n := (q.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, n, n), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.dark[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				row := ((y+qrQuietZone)*scale + py) * img.Stride
+				for px := 0; px < scale; px++ {
+					img.Pix[row+(x+qrQuietZone)*scale+px] = 1
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// svg renders the code as one path, one unit per module.
+func (q *qrCode) svg() []byte {
+	n := q.size + 2*qrQuietZone
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.dark[y][x] {
+				fmt.Fprintf(&b, "M%d,%dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+// shareExists reports whether a share of the given URL type ("c", "f",
+// "b" or "r") exists.
+func shareExists(typ, id string) bool {
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+	if typ == "r" {
+		return rooms[id] != nil
+	}
+	kind, ok := shareKinds[typ]
+	if !ok {
+		return false
+	}
+	_, ok = findShare(kind, id)
+	return ok
+}
+
+// qrHandler serves /qr/{type}/{id}.png and .svg, a QR code of a share's
+// URL.
+func qrHandler(w http.ResponseWriter, r *http.Request) {
+	typ, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/qr/"), "/")
+	id, format := name, ""
+	for _, ext := range []string{".png", ".svg"} {
+		if base, ok := strings.CutSuffix(name, ext); ok {
+			id, format = base, ext
+		}
+	}
+	if format == "" || !shareExists(typ, id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	code, err := encodeQR([]byte(shareURL(r, typ, id)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=43200")
+	if format == ".svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(code.svg())
+		return
+	}
+	data, err := code.png(8)
+	if err != nil {
+		http.Error(w, "Failed to draw QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRSRemainder(t *testing.T) {
+	// "HELLO WORLD" at version 1-M, the worked example from the standard's
+	// tutorials
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("error correction %v, want %v", got, want)
+	}
+}
+
+// readFormat reads the level and mask from the copy of the format bits
+// around the top left finder, checking the one split between the other two
+// agrees.
+func readFormat(t *testing.T, q *qrCode) (level, mask int) {
+	t.Helper()
+	var first, second int
+	bit := func(x, y, i int, into *int) {
+		if q.dark[y][x] {
+			*into |= 1 << i
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		bit(8, i, i, &first)
+	}
+	bit(8, 7, 6, &first)
+	bit(8, 8, 7, &first)
+	bit(7, 8, 8, &first)
+	for i := 9; i < 15; i++ {
+		bit(14-i, 8, i, &first)
+	}
+	for i := 0; i < 8; i++ {
+		bit(q.size-1-i, 8, i, &second)
+	}
+	for i := 8; i < 15; i++ {
+		bit(8, q.size-15+i, i, &second)
+	}
+	if first != second {
+		t.Fatalf("format copies differ: %015b and %015b", first, second)
+	}
+	if !q.dark[q.size-8][8] {
+		t.Error("dark module is light")
+	}
+
+	bits := first ^ 0x5412
+	rem := bits
+	for i := 14; i >= 10; i-- {
+		if rem>>i&1 != 0 {
+			rem ^= 0x537 << (i - 10)
+		}
+	}
+	if rem != 0 {
+		t.Fatalf("format bits %015b fail their BCH check", bits)
+	}
+	return bits >> 13, bits >> 10 & 7
+}
+
+// readCodewords reads a single-block code's codewords back out of it, the
+// way a scanner does once it has found the mask.
+func readCodewords(q *qrCode, mask int) []byte {
+	q.applyMask(mask)
+	defer q.applyMask(mask)
+	var out []byte
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if q.function[y][x] {
+					continue
+				}
+				if i%8 == 0 {
+					out = append(out, 0)
+				}
+				if q.dark[y][x] {
+					out[i/8] |= 1 << (7 - i%8)
+				}
+				i++
+			}
+		}
+	}
+	return out[:i/8]
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, tt := range []struct {
+		data    string
+		version int
+	}{
+		{"https://clip.example/c/x", 2},
+		{"https://clip.example/c/calm-star", 3},
+		{"http://a", 1},
+	} {
+		q, err := encodeQR([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.size != tt.version*4+17 {
+			t.Errorf("%q: size %d, want version %d", tt.data, q.size, tt.version)
+		}
+		// Finder pattern corners: dark ring, light ring, dark centre
+		for _, c := range [][2]int{{0, 0}, {q.size - 7, 0}, {0, q.size - 7}} {
+			if !q.dark[c[1]][c[0]] || q.dark[c[1]+1][c[0]+1] || !q.dark[c[1]+3][c[0]+3] {
+				t.Errorf("%q: no finder pattern at %v", tt.data, c)
+			}
+		}
+
+		level, mask := readFormat(t, q)
+		if level != 0 {
+			t.Errorf("%q: level bits %02b, want M (00)", tt.data, level)
+		}
+		codewords := readCodewords(q, mask)
+		nData := qrDataCodewords(tt.version)
+		data, ecc := codewords[:nData], codewords[nData:]
+		if !bytes.Equal(rsRemainder(data, rsDivisor(len(ecc))), ecc) {
+			t.Errorf("%q: error correction doesn't match the data", tt.data)
+		}
+		// Byte mode, the length, then the bytes themselves, shifted by the
+		// 4-bit mode indicator
+		if data[0]>>4 != 0b0100 || int(data[0]&0xf<<4|data[1]>>4) != len(tt.data) {
+			t.Fatalf("%q: header %08b %08b", tt.data, data[0], data[1])
+		}
+		var got []byte
+		for i := range len(tt.data) {
+			got = append(got, data[i+1]<<4|data[i+2]>>4)
+		}
+		if string(got) != tt.data {
+			t.Errorf("encoded %q, want %q", got, tt.data)
+		}
+	}
+
+	if _, err := encodeQR(bytes.Repeat([]byte("x"), 3000)); err != errQRTooLong {
+		t.Errorf("3000 bytes gave %v, want %v", err, errQRTooLong)
+	}
+}
+
+func TestQRHandler(t *testing.T) {
+	const id = "qr-test"
+	entriesMu.Lock()
+	shares[id] = Share{ID: id, Kind: KindText, ExpiresAt: time.Now().Add(time.Hour)}
+	entriesMu.Unlock()
+	defer func() {
+		entriesMu.Lock()
+		delete(shares, id)
+		entriesMu.Unlock()
+	}()
+
+	for _, tt := range []struct {
+		path string
+		code int
+		typ  string
+	}{
+		{"/qr/c/" + id + ".svg", http.StatusOK, "image/svg+xml"},
+		{"/qr/c/" + id + ".png", http.StatusOK, "image/png"},
+		{"/qr/c/" + id + ".gif", http.StatusNotFound, ""},
+		{"/qr/f/" + id + ".svg", http.StatusNotFound, ""},
+		{"/qr/c/missing.svg", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		qrHandler(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.path, w.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.typ {
+			t.Errorf("%s: type %q, want %q", tt.path, got, tt.typ)
+		}
+		if tt.typ == "image/png" {
+			if _, err := png.Decode(w.Body); err != nil {
+				t.Errorf("%s: %v", tt.path, err)
+			}
+		} else if !strings.HasPrefix(w.Body.String(), "<svg") {
+			t.Errorf("%s: not an SVG", tt.path)
+		}
+	}
+}
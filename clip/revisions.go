@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Revision is one saved version of a text share.
+type Revision struct {
+	Content  string `json:"-"` // kept in revisionPath's file
+	Language string
+	SavedAt  time.Time
+}
+
+// maxRevisions bounds how many times a share can be edited.
+const maxRevisions = 100
+
+// revisionPath is where revision n (1-based) of a text share is stored.
+func revisionPath(key string, n int) string {
+	return blobPath(key) + ".v" + strconv.Itoa(n)
+}
+
+// removeClipboardFiles deletes every stored revision of a text share.
+func removeClipboardFiles(entry Share) {
+	for n := 1; n <= max(len(entry.Revisions), 1); n++ {
+		path := revisionPath(entry.Key, n)
+		if err := removeUpload(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed to remove clipboard file", "path", path, "err", err)
+		}
+	}
+}
+
+type revisionLink struct {
+	N       int
+	SavedAt time.Time
+	Current bool
+}
+
+func (l revisionLink) Prev() int { return l.N - 1 }
+
+func revisionLinks(entry Share, current int) []revisionLink {
+	links := make([]revisionLink, len(entry.Revisions))
+	for i, rev := range entry.Revisions {
+		links[i] = revisionLink{N: i + 1, SavedAt: rev.SavedAt, Current: i+1 == current}
+	}
+	return links
+}
+
+// editClipboardHandler serves /c/{id}/edit: the edit form on GET, and on
+// POST saves a new revision. Only the holder of the manage token may edit.
+// Edits don't extend the share's life.
+func editClipboardHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entriesMu.Lock()
+	entry, exists := findShare(KindText, id)
+	entriesMu.Unlock()
+	if !exists {
+		http.Error(w, "Clipboard entry not found or expired", http.StatusNotFound)
+		return
+	}
+	if !canManage(r, id, entry.ManageTokenHash) {
+		http.Error(w, "Editing requires this share's manage token", http.StatusForbidden)
+		return
+	}
+	if entry.Live() {
+		http.Error(w, "This is a live scratchpad; edit it on its page or finish it first", http.StatusConflict)
+		return
+	}
+
+	if r.Method == "GET" {
+		render(w, "edit.html", struct {
+			Share
+			Version   int
+			Token     string
+			CSRFToken string
+			Languages []*language
+		}{
+			Share:     entry,
+			Version:   len(entry.Revisions),
+			Token:     r.FormValue("token"),
+			CSRFToken: csrfToken(w, r),
+			Languages: languages,
+		})
+		return
+	}
+
+	content := r.FormValue("content")
+	if strings.TrimSpace(content) == "" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+	language := r.FormValue("language")
+	if language == "" {
+		language = entry.Language
+	} else if lookupLanguage(language) == nil {
+		language = detectLanguage(content)
+	}
+
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+
+	// The share may have expired or changed while the form was parsed
+	entry, exists = findShare(KindText, id)
+	if !exists {
+		http.Error(w, "Clipboard entry not found or expired", http.StatusNotFound)
+		return
+	}
+	version := len(entry.Revisions)
+	if content != entry.Content || language != entry.Language {
+		if version >= maxRevisions {
+			http.Error(w, fmt.Sprintf("This share already has %d revisions", maxRevisions), http.StatusConflict)
+			return
+		}
+		version++
+		if err := writeUpload(revisionPath(entry.Key, version), []byte(content)); err != nil {
+			if errors.Is(err, errStorageFull) {
+				rejectStorageFull(w)
+				return
+			}
+			slog.Error("Failed to save clipboard revision", "id", id, "version", version, "err", err)
+			http.Error(w, "Failed to save revision", http.StatusInternalServerError)
+			return
+		}
+		entry.Revisions = append(entry.Revisions, Revision{Content: content, Language: language, SavedAt: time.Now()})
+		entry.setContent(content)
+		entry.Language = language
+		putShare(entry)
+
+		sharesEdited.inc()
+		audit(r, "edited", "text", id, "version", version, "bytes", len(content), "language", language)
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"id":      id,
+			"version": version,
+			"url":     fmt.Sprintf("/c/%s/v/%d", id, version),
+		})
+		return
+	}
+	http.Redirect(w, r, "/c/"+id, http.StatusSeeOther)
+}
+
+// diffHandler serves /c/{id}/diff?from=a&to=b, comparing two revisions.
+// By default it shows what the latest edit changed.
+func diffHandler(w http.ResponseWriter, r *http.Request, id string) {
+	entriesMu.Lock()
+	entry, exists := findShare(KindText, id)
+	entriesMu.Unlock()
+	if !exists {
+		http.Error(w, "Clipboard entry not found or expired", http.StatusNotFound)
+		return
+	}
+
+	count := len(entry.Revisions)
+	version := func(name string, def int) (int, bool) {
+		s := r.URL.Query().Get(name)
+		if s == "" {
+			return def, true
+		}
+		n, err := strconv.Atoi(s)
+		return n, err == nil && n >= 1 && n <= count
+	}
+	from, ok1 := version("from", max(count-1, 1))
+	to, ok2 := version("to", count)
+	if !ok1 || !ok2 {
+		http.Error(w, "No such version", http.StatusNotFound)
+		return
+	}
+
+	lines := diffLines(splitLines(entry.Revisions[from-1].Content), splitLines(entry.Revisions[to-1].Content))
+	added, removed := 0, 0
+	for _, l := range lines {
+		switch l.Op {
+		case diffInsert:
+			added++
+		case diffDelete:
+			removed++
+		}
+	}
+	audit(r, "viewed", "text", id, "diff", fmt.Sprintf("%d..%d", from, to))
+
+	render(w, "diff.html", struct {
+		ID       string
+		From, To int
+		Versions []revisionLink
+		Lines    []diffLine
+		Added    int
+		Removed  int
+	}{
+		ID:       id,
+		From:     from,
+		To:       to,
+		Versions: revisionLinks(entry, 0),
+		Lines:    collapseDiff(lines, 3),
+		Added:    added,
+		Removed:  removed,
+	})
+}
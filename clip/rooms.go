@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Rooms sync shares between devices. Anything pasted or uploaded into a
+// room is an ordinary share that also appears, live, on every device with
+// the room open. Rooms expire like shares, 12 hours after they were opened.
+
+type Room struct {
+	ID        string
+	CreatedAt time.Time
+	Items     []RoomItem // oldest first
+
+	hub *hub
+}
+
+// ExpiresAt is when the room closes, shareTTL after it was opened.
+func (r *Room) ExpiresAt() time.Time {
+	return r.CreatedAt.Add(shareTTL)
+}
+
+// RoomItem points at a share posted to a room.
+type RoomItem struct {
+	Type      string    `json:"type"` // "text", "file" or "bundle"
+	ID        string    `json:"id"`
+	Preview   string    `json:"preview,omitempty"`
+	Filename  string    `json:"filename,omitempty"`
+	Size      int64     `json:"size"`
+	SizeLabel string    `json:"size_label"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// maxRoomItems bounds a room's list; older shares drop off it but stay
+// reachable by their own URL until they expire.
+const maxRoomItems = 200
+
+// rooms is guarded by entriesMu, like the share maps.
+var rooms = make(map[string]*Room)
+
+// textPreview returns the start of a text share for listing.
+func textPreview(content string) string {
+	const limit = 300
+	if utf8.RuneCountInString(content) <= limit {
+		return content
+	}
+	runes := []rune(content)
+	return string(runes[:limit]) + "…"
+}
+
+// addRoomItem posts a share to a room. Called with entriesMu held.
+func addRoomItem(roomID string, item RoomItem) {
+	room := rooms[roomID]
+	if room == nil {
+		return
+	}
+	item.SizeLabel = formatBytes(item.Size)
+	room.Items = append(room.Items, item)
+	if len(room.Items) > maxRoomItems {
+		room.Items = append([]RoomItem(nil), room.Items[len(room.Items)-maxRoomItems:]...)
+	}
+	room.hub.publish(newEvent("item", item))
+}
+
+// removeRoomItem takes a deleted or expired share off its room. Called
+// with entriesMu held.
+func removeRoomItem(roomID, itemType, id string) {
+	room := rooms[roomID]
+	if room == nil {
+		return
+	}
+	for i, item := range room.Items {
+		if item.Type == itemType && item.ID == id {
+			room.Items = append(room.Items[:i:i], room.Items[i+1:]...)
+			room.hub.publish(newEvent("removed", map[string]string{"type": itemType, "id": id}))
+			return
+		}
+	}
+}
+
+// closeRoom removes a room and tells its devices. Called with entriesMu
+// held.
+func closeRoom(room *Room) {
+	delete(rooms, room.ID)
+	room.hub.publish(newEvent("closed", nil))
+	room.hub.close()
+}
+
+// createRoomHandler opens a new room and sends the browser into it.
+func createRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entriesMu.Lock()
+	id, err := claimID("")
+	if err != nil {
+		entriesMu.Unlock()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	room := &Room{ID: id, CreatedAt: time.Now(), hub: &hub{}}
+	rooms[id] = room
+	expiries.schedule(id, room.ExpiresAt())
+	entriesMu.Unlock()
+
+	sharesCreated.inc("room")
+	audit(r, "created", "room", id)
+	http.Redirect(w, r, "/r/"+id, http.StatusSeeOther)
+}
+
+// roomHandler serves /r/{id}, the room page, and /r/{id}/events, its live
+// feed.
+func roomHandler(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/r/"), "/")
+	if rest != "" && rest != "events" {
+		http.NotFound(w, r)
+		return
+	}
+
+	entriesMu.Lock()
+	room := rooms[id]
+	if room == nil || !time.Now().Before(room.ExpiresAt()) {
+		entriesMu.Unlock()
+		http.Error(w, "Room not found or expired", http.StatusNotFound)
+		return
+	}
+	items := make([]RoomItem, len(room.Items))
+	copy(items, room.Items)
+	createdAt := room.CreatedAt
+	// Subscribe while the list can't change, so nothing falls in between
+	var ch chan sseEvent
+	if rest == "events" {
+		ch = room.hub.subscribe()
+	}
+	entriesMu.Unlock()
+
+	if rest == "events" {
+		defer room.hub.unsubscribe(ch)
+		serveEvents(w, r, ch, newEvent("snapshot", items))
+		return
+	}
+
+	// Newest first
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	render(w, "room.html", struct {
+		ID        string
+		URL       string
+		TimeLeft  string
+		Items     []RoomItem
+		CSRFToken string
+	}{
+		ID:        id,
+		URL:       r.Host + r.URL.Path,
+		TimeLeft:  formatDuration(time.Until(createdAt.Add(shareTTL))),
+		Items:     items,
+		CSRFToken: csrfToken(w, r),
+	})
+}
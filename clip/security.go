@@ -0,0 +1,38 @@
+package main
+
+import "net/http"
+
+// secureHeaders sets the security headers every response carries. Pages may
+// only load scripts and styles from /static/, and can't be framed.
+func secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self' data:; connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		// Share URLs are the only secret protecting a share, so never leak
+		// them to other sites
+		h.Set("Referrer-Policy", "no-referrer")
+		if isHTTPS(r) {
+			h.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sandboxUserContent replaces the page policy for responses carrying
+// user-uploaded bytes: nothing in them may run scripts, load resources or
+// reach our origin's cookies and storage, even if a browser renders them.
+func sandboxUserContent(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cross-Origin-Resource-Policy", "same-origin")
+}
+
+// isHTTPS reports whether the client reached us over TLS, directly or via a
+// trusted proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || (trustProxy && r.Header.Get("X-Forwarded-Proto") == "https")
+}
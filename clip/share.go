@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A share is anything posted for others to open: text, a single file or a
+// bundle of files. Every kind lives in the one shares map and goes through
+// the same lifecycle, created by addShare and removed by removeShare when it
+// expires or is deleted. /c/, /f/ and /b/ are views over the kind-specific
+// fields.
+
+type ShareKind string
+
+const (
+	KindText   ShareKind = "text"
+	KindFile   ShareKind = "file"
+	KindBundle ShareKind = "bundle"
+)
+
+// shareKinds maps the URL segment of each kind's pages to the kind.
+var shareKinds = map[string]ShareKind{"c": KindText, "f": KindFile, "b": KindBundle}
+
+// urlType is the kind's URL segment, as in /c/{id}.
+func (k ShareKind) urlType() string {
+	for typ, kind := range shareKinds {
+		if kind == k {
+			return typ
+		}
+	}
+	return ""
+}
+
+type ShareFlags uint8
+
+const (
+	FlagLive     ShareFlags = 1 << iota // text anyone with the link can edit
+	FlagVanity                          // ID chosen by the creator
+	FlagStripped                        // photo metadata removed on upload
+)
+
+// shareTTL is how long a share lasts after it is created.
+const shareTTL = 12 * time.Hour
+
+type Share struct {
+	ID        string
+	Kind      ShareKind
+	CreatedAt time.Time
+	// ExpiresAt starts as CreatedAt plus shareTTL. Edits don't move it,
+	// but the admin dashboard can.
+	ExpiresAt time.Time
+
+	Size            int64  // bytes: the latest text, the file, or all of a bundle's files
+	MIME            string // of the text or file; bundles have none
+	Hash            string // hex SHA-256 of the latest text or the file; bundles have none
+	Owner           string // creator's client IP
+	Views           int
+	Flags           ShareFlags
+	ManageTokenHash string
+	Room            string // the sync room it was posted to, if any
+	Key             string // where its files are stored; see blobPath
+
+	// Text shares. Revisions holds every saved version, oldest first. Its
+	// elements are shared with copies of the share, so it is replaced or
+	// appended to but never changed in place.
+	Content   string `json:"-"` // latest revision; kept in uploads/, not the store
+	Language  string
+	Revisions []Revision
+
+	// File shares
+	Filename  string
+	Thumbnail string // the image's thumbnail in uploads/, if it has one
+
+	// Bundles
+	Files []BundleFile
+}
+
+// Live reports whether a text share is a scratchpad that everyone with the
+// link can edit until its owner finishes it.
+func (s Share) Live() bool {
+	return s.Flags&FlagLive != 0
+}
+
+// Label describes the share in lists: a file's name, or for a bundle its
+// folder's name or how many files it has.
+func (s Share) Label() string {
+	switch s.Kind {
+	case KindFile:
+		return s.Filename
+	case KindBundle:
+		return bundleLabel(s.Files)
+	}
+	return s.ID
+}
+
+// setContent makes content the text share's latest text.
+func (s *Share) setContent(content string) {
+	s.Content = content
+	s.Size = int64(len(content))
+	s.MIME = "text/plain; charset=utf-8"
+	s.Hash = hashString(content)
+}
+
+// shares is guarded by entriesMu.
+var shares = make(map[string]Share)
+
+// Expired reports whether the share's time is up. Cleanup may not have
+// removed it yet.
+func (s Share) Expired() bool {
+	return !time.Now().Before(s.ExpiresAt)
+}
+
+// findShare looks up a share of the given kind that hasn't expired. The
+// caller holds entriesMu.
+func findShare(kind ShareKind, id string) (Share, bool) {
+	s, ok := shares[id]
+	if !ok || s.Kind != kind || s.Expired() {
+		return Share{}, false
+	}
+	return s, true
+}
+
+// getShare is findShare for callers that don't hold entriesMu.
+func getShare(kind ShareKind, id string) (Share, bool) {
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+	return findShare(kind, id)
+}
+
+// loadShares fills shares from the metadata store at startup, reading text
+// back from uploads/. Shares whose files have gone are dropped.
+func loadShares(all map[string]Share) {
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+	for id, s := range all {
+		if err := readContent(&s); err != nil {
+			slog.Warn("Dropping share whose files are missing", "kind", s.Kind, "id", id, "err", err)
+			if err := store.delete(id); err != nil {
+				slog.Error("Failed to record share", "id", id, "err", err)
+			}
+			continue
+		}
+		// Rooms don't outlive the process
+		s.Room = ""
+		shares[id] = s
+		expiries.schedule(id, s.ExpiresAt)
+	}
+}
+
+// readContent loads a text share's revisions from uploads/, and checks that
+// a file or bundle is still there.
+func readContent(s *Share) error {
+	if !validKey(s.Key) {
+		return fmt.Errorf("invalid storage key %q", s.Key)
+	}
+	switch s.Kind {
+	case KindText:
+		for n := range s.Revisions {
+			data, err := os.ReadFile(revisionPath(s.Key, n+1))
+			if err != nil {
+				return err
+			}
+			s.Revisions[n].Content = string(data)
+		}
+		if len(s.Revisions) == 0 {
+			return errors.New("no revisions")
+		}
+		s.Content = s.Revisions[len(s.Revisions)-1].Content
+		return nil
+	case KindFile:
+		_, err := os.Stat(blobPath(s.Key))
+		return err
+	case KindBundle:
+		_, err := os.Stat(bundleDir(s.Key))
+		return err
+	}
+	return fmt.Errorf("unknown kind %q", s.Kind)
+}
+
+// addShare stores a new share, posts it to its room and records its
+// creation. The caller holds entriesMu, and has claimed s.ID under it. If
+// the share can't be recorded its files are removed.
+func addShare(r *http.Request, s Share, attrs ...any) error {
+	s.Owner = clientIP(r)
+	s.ExpiresAt = s.CreatedAt.Add(shareTTL)
+	if err := store.put(s); err != nil {
+		slog.Error("Failed to record share", "kind", s.Kind, "id", s.ID, "err", err)
+		removeShareFiles(s)
+		return err
+	}
+	shares[s.ID] = s
+	expiries.schedule(s.ID, s.ExpiresAt)
+	if s.Room != "" {
+		addRoomItem(s.Room, roomItem(s))
+	}
+	sharesCreated.inc(string(s.Kind))
+	audit(r, "created", string(s.Kind), s.ID, attrs...)
+	compactStore()
+	return nil
+}
+
+// putShare saves changes to a stored share. The caller holds entriesMu.
+func putShare(s Share) {
+	shares[s.ID] = s
+	delete(unsavedViews, s.ID)
+	expiries.schedule(s.ID, s.ExpiresAt)
+	if err := store.put(s); err != nil {
+		slog.Error("Failed to record share", "kind", s.Kind, "id", s.ID, "err", err)
+	}
+	compactStore()
+}
+
+// compactStore folds the store's log into a new snapshot once it has grown
+// large. The caller holds entriesMu.
+func compactStore() {
+	if !store.needsSnapshot() {
+		return
+	}
+	if err := store.snapshot(shares); err != nil {
+		slog.Error("Failed to snapshot share metadata", "err", err)
+	}
+}
+
+// roomItem is how a share appears in its sync room.
+func roomItem(s Share) RoomItem {
+	item := RoomItem{Type: string(s.Kind), ID: s.ID, Size: s.Size, CreatedAt: s.CreatedAt}
+	switch s.Kind {
+	case KindText:
+		item.Preview = textPreview(s.Content)
+	case KindFile:
+		item.Filename = s.Filename
+	case KindBundle:
+		item.Filename = s.Label()
+	}
+	return item
+}
+
+// removeShare forgets a share and deletes everything it stored. The caller
+// holds entriesMu, and records why it went.
+func removeShare(s Share) {
+	delete(shares, s.ID)
+	delete(unsavedViews, s.ID)
+	expiries.cancel(s.ID)
+	if err := store.delete(s.ID); err != nil {
+		slog.Error("Failed to record share", "kind", s.Kind, "id", s.ID, "err", err)
+	}
+	removeShareFiles(s)
+}
+
+// removeShareFiles deletes a share's files, after it has been forgotten.
+func removeShareFiles(s Share) {
+	closePad(s.ID)
+	forgetArchive(s.ID)
+	removeRoomItem(s.Room, string(s.Kind), s.ID)
+	// A share recorded before storage keys whose files were never moved
+	if !validKey(s.Key) {
+		return
+	}
+	switch s.Kind {
+	case KindText:
+		removeClipboardFiles(s)
+	case KindFile:
+		path := blobPath(s.Key)
+		if err := removeUpload(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed to remove file", "path", path, "err", err)
+		}
+		removeThumbnail(s)
+	case KindBundle:
+		removeBundleFiles(s)
+	}
+}
+
+// Views are counted in memory and saved in batches: a share's record can
+// be large, and rewriting it on every view of a popular link would keep
+// entriesMu held for a disk sync per request. A crash loses at most the
+// last viewSaveDelay of counts.
+
+// viewSaveDelay is how long new view counts may wait to be saved.
+const viewSaveDelay = 30 * time.Second
+
+// unsavedViews holds the IDs whose view counts changed since they were
+// last saved. Guarded by entriesMu.
+var unsavedViews = make(map[string]bool)
+
+// countView records that a share was viewed or downloaded.
+func countView(s Share) {
+	entriesMu.Lock()
+	if current, ok := shares[s.ID]; ok {
+		current.Views++
+		shares[s.ID] = current
+		if len(unsavedViews) == 0 {
+			time.AfterFunc(viewSaveDelay, saveViews)
+		}
+		unsavedViews[s.ID] = true
+	}
+	entriesMu.Unlock()
+	sharesViewed.inc(string(s.Kind))
+}
+
+// saveViews writes the view counts that changed to the store as one small
+// record.
+func saveViews() {
+	entriesMu.Lock()
+	defer entriesMu.Unlock()
+	if len(unsavedViews) == 0 {
+		return
+	}
+	views := make(map[string]int, len(unsavedViews))
+	for id := range unsavedViews {
+		if s, ok := shares[id]; ok {
+			views[id] = s.Views
+		}
+	}
+	clear(unsavedViews)
+	if err := store.commit(metaOp{Views: views}); err != nil {
+		slog.Error("Failed to record view counts", "shares", len(views), "err", err)
+	}
+	compactStore()
+}
+
+// shareRedirectHandler serves /s/{id}, sending any share's ID on to the
+// page for its kind.
+func shareRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/s/")
+	entriesMu.Lock()
+	s, ok := shares[id]
+	entriesMu.Unlock()
+	if !ok || s.Expired() {
+		http.Error(w, "Share not found or expired", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/"+s.Kind.urlType()+"/"+id, http.StatusSeeOther)
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the hex SHA-256 of a file's contents.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// detectMIME guesses a stored file's type from its name, or failing that
+// from its first bytes.
+func detectMIME(path, name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n])
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed templates static
+var embeddedFiles embed.FS
+
+var (
+	// devMode reloads templates and assets from the working directory on
+	// every request instead of using the embedded copies.
+	devMode bool
+	// themeDir holds operator overrides: files in themeDir/templates and
+	// themeDir/static replace the built-in ones of the same name.
+	themeDir string
+)
+
+// site is a parsed set of templates and static assets.
+type site struct {
+	templates *template.Template
+	assets    map[string]*staticAsset
+}
+
+type staticAsset struct {
+	data        []byte
+	hash        string
+	contentType string
+}
+
+var (
+	currentSite   *site
+	currentSiteMu sync.Mutex
+	startTime     = time.Now()
+)
+
+// loadSite parses every template and hashes every static asset once.
+func loadSite() (*site, error) {
+	var base fs.FS = embeddedFiles
+	if devMode {
+		base = os.DirFS(".")
+	}
+
+	s := &site{assets: make(map[string]*staticAsset)}
+
+	staticNames, err := fs.Glob(base, "static/*")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range staticNames {
+		data, err := readLayered(base, name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		s.assets[path.Base(name)] = &staticAsset{
+			data:        data,
+			hash:        hex.EncodeToString(sum[:])[:12],
+			contentType: contentType,
+		}
+	}
+
+	s.templates = template.New("").Funcs(template.FuncMap{
+		"asset": s.assetURL,
+	})
+	templateNames, err := fs.Glob(base, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range templateNames {
+		data, err := readLayered(base, name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.templates.New(path.Base(name)).Parse(string(data)); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// readLayered reads name from the theme directory if it overrides it, and
+// from base otherwise.
+func readLayered(base fs.FS, name string) ([]byte, error) {
+	if themeDir != "" {
+		data, err := os.ReadFile(filepath.Join(themeDir, filepath.FromSlash(name)))
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return fs.ReadFile(base, name)
+}
+
+// assetURL returns the content-addressed URL of a static asset.
+func (s *site) assetURL(name string) string {
+	a, ok := s.assets[name]
+	if !ok {
+		return "/static/" + name
+	}
+	return "/static/" + name + "?v=" + a.hash
+}
+
+// getSite returns the parsed site, reloading it from disk in dev mode.
+func getSite() (*site, error) {
+	currentSiteMu.Lock()
+	defer currentSiteMu.Unlock()
+	if currentSite == nil || devMode {
+		s, err := loadSite()
+		if err != nil {
+			return nil, err
+		}
+		currentSite = s
+	}
+	return currentSite, nil
+}
+
+// render executes the named template into a buffer first, so a failing
+// template produces a clean 500 instead of half a page.
+func render(w http.ResponseWriter, name string, data any) {
+	s, err := getSite()
+	if err != nil {
+		slog.Error("Failed to load templates", "err", err)
+		http.Error(w, "Failed to load templates", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.templates.ExecuteTemplate(&buf, name, data); err != nil {
+		slog.Error("Failed to render template", "template", name, "err", err)
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// staticHandler serves embedded assets. Requests carrying the current
+// content hash are cacheable forever; anything else must revalidate.
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := getSite()
+	if err != nil {
+		http.Error(w, "Failed to load assets", http.StatusInternalServerError)
+		return
+	}
+	a, ok := s.assets[strings.TrimPrefix(r.URL.Path, "/static/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("ETag", `"`+a.hash+`"`)
+	if r.URL.Query().Get("v") == a.hash && !devMode {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, "", startTime, bytes.NewReader(a.data))
+}
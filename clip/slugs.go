@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Creators may pick their own ID ("vanity slug"), such as /c/deploy-notes,
+// instead of a random adjective-noun pair. Every ID, chosen or generated,
+// is unique across shares of all kinds and rooms, because a share's manage
+// cookie is keyed by the bare ID.
+
+const (
+	// Short names are the ones worth squatting, so they stay random
+	minSlugLength = 6
+	maxSlugLength = 64
+
+	// idAttempts bounds the random IDs tried of each length. There are only
+	// a few thousand adjective-noun pairs, so once most are in use new IDs
+	// get a number on the end.
+	idAttempts = 16
+)
+
+// reservedSlugs are refused as IDs: the names of top-level routes and
+// ones that would look official.
+var reservedSlugs = map[string]bool{
+	"api": true, "admin": true, "static": true,
+	"created": true, "delete": true, "upload": true, "clipboard": true,
+	"rooms": true, "healthz": true, "readyz": true, "metrics": true,
+}
+
+var (
+	errSlugTaken = errors.New("that link is already taken")
+	errNoFreeID  = errors.New("no free links left; please try again later")
+)
+
+// cleanSlug validates a requested slug, returning it in lower case. An
+// empty request is fine and means a random ID.
+func cleanSlug(slug string) (string, error) {
+	slug = strings.ToLower(strings.TrimSpace(slug))
+	if slug == "" {
+		return "", nil
+	}
+	if len(slug) < minSlugLength || len(slug) > maxSlugLength {
+		return "", fmt.Errorf("custom links must be %d to %d characters long", minSlugLength, maxSlugLength)
+	}
+	for i := 0; i < len(slug); i++ {
+		c := slug[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return "", errors.New("custom links may only use letters, digits and hyphens")
+		}
+	}
+	if slug[0] == '-' || slug[len(slug)-1] == '-' || strings.Contains(slug, "--") {
+		return "", errors.New("custom links can't start or end with a hyphen, or have two in a row")
+	}
+	if reservedSlugs[slug] {
+		return "", errors.New("that link is reserved")
+	}
+	return slug, nil
+}
+
+// idTaken reports whether any share or room uses id. The caller holds
+// entriesMu.
+func idTaken(id string) bool {
+	_, ok := shares[id]
+	return ok || rooms[id] != nil
+}
+
+// claimID returns the ID for a new share: slug if one was chosen and it's
+// free, otherwise a fresh random ID. The caller holds entriesMu and must
+// store the share before releasing it, so nobody else can claim the same
+// ID in between.
+func claimID(slug string) (string, error) {
+	if slug != "" {
+		if idTaken(slug) || reservedSlugs[slug] {
+			return "", errSlugTaken
+		}
+		return slug, nil
+	}
+	for i := 0; i < 2*idAttempts; i++ {
+		id := generateReadableID()
+		if i >= idAttempts {
+			n, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				break
+			}
+			id = fmt.Sprintf("%s-%04d", id, n.Int64())
+		}
+		if !idTaken(id) {
+			return id, nil
+		}
+	}
+	return "", errNoFreeID
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server-sent event streams, used to push live updates to browsers.
+
+type sseEvent struct {
+	Name string
+	Data []byte
+}
+
+func newEvent(name string, v any) sseEvent {
+	data, _ := json.Marshal(v)
+	return sseEvent{Name: name, Data: data}
+}
+
+// hub fans events out to its subscribers. A subscriber that falls behind is
+// dropped rather than allowed to stall everyone else; its browser
+// reconnects and starts again from a fresh snapshot.
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan sseEvent]bool
+}
+
+func (h *hub) subscribe() chan sseEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan sseEvent]bool)
+	}
+	ch := make(chan sseEvent, 64)
+	h.subs[ch] = true
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan sseEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *hub) publish(ev sseEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every subscriber's stream.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		close(ch)
+	}
+	h.subs = nil
+}
+
+var (
+	// streamsDone is closed on shutdown so open streams don't hold up
+	// the graceful drain.
+	streamsDone = make(chan struct{})
+	openStreams atomic.Int64
+)
+
+// closeStreams ends all event streams; it is registered with the server's
+// shutdown.
+func closeStreams() {
+	close(streamsDone)
+}
+
+// serveEvents streams events from ch to the client until it disconnects,
+// the stream is closed or the server shuts down. initial events are sent
+// first.
+func serveEvents(w http.ResponseWriter, r *http.Request, ch <-chan sseEvent, initial ...sseEvent) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+
+	openStreams.Add(1)
+	defer openStreams.Add(-1)
+
+	for _, ev := range initial {
+		writeEvent(w, ev)
+	}
+	flusher.Flush()
+
+	// Comments keep idle connections from being cut by proxies
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, ev)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-streamsDone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev sseEvent) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+}
@@ -0,0 +1,21 @@
+const sharesForm = document.getElementById('sharesForm');
+const selectAll = document.getElementById('selectAll');
+const boxes = () => [...sharesForm.querySelectorAll('input.select')];
+
+selectAll.addEventListener('change', () => {
+    boxes().forEach((box) => { box.checked = selectAll.checked; });
+});
+
+sharesForm.addEventListener('submit', (e) => {
+    const selected = boxes().filter((box) => box.checked).length;
+    if (selected === 0) {
+        e.preventDefault();
+        alert('Select some shares first.');
+        return;
+    }
+    // Deleting can't be undone, so ask first
+    if (e.submitter && e.submitter.value === 'delete' &&
+        !confirm(`Delete ${selected} share${selected === 1 ? '' : 's'} and their files?`)) {
+        e.preventDefault();
+    }
+});
@@ -0,0 +1,19 @@
+// The page works without this: the link can be selected by hand and the
+// delete form posts on its own
+const copyURL = document.querySelector('.copy-url');
+copyURL.addEventListener('click', () => {
+    navigator.clipboard.writeText(copyURL.dataset.url).then(() => {
+        copyURL.textContent = 'Copied!';
+        setTimeout(() => {
+            copyURL.textContent = 'Copy';
+        }, 1000);
+    });
+});
+
+document.getElementById('shareURL').addEventListener('focus', (e) => e.target.select());
+
+document.querySelector('.delete-share').addEventListener('submit', (e) => {
+    if (!confirm('Are you sure you want to delete this share? This action cannot be undone.')) {
+        e.preventDefault();
+    }
+});
@@ -0,0 +1,215 @@
+// Handle drag and drop
+const uploadArea = document.querySelector('.upload-area');
+const fileInput = document.getElementById('fileInput');
+const folderInput = document.getElementById('folderInput');
+const uploadForm = document.getElementById('uploadForm');
+
+// Files from a folder, as {file, path}. A plain form submission can't
+// carry a dropped folder's structure, so these are sent with fetch, each
+// under its path within the folder.
+let folderFiles = null;
+
+uploadArea.addEventListener('click', () => fileInput.click());
+
+uploadArea.addEventListener('dragover', (e) => {
+    e.preventDefault();
+    uploadArea.classList.add('dragover');
+});
+
+uploadArea.addEventListener('dragleave', (e) => {
+    e.preventDefault();
+    uploadArea.classList.remove('dragover');
+});
+
+uploadArea.addEventListener('drop', (e) => {
+    e.preventDefault();
+    uploadArea.classList.remove('dragover');
+    // Entries must be taken during the event; reading them can wait
+    const entries = [...e.dataTransfer.items].map((item) => item.webkitGetAsEntry && item.webkitGetAsEntry()).filter(Boolean);
+    if (entries.some((entry) => entry.isDirectory)) {
+        fileInput.value = '';
+        collectFiles(entries).then((files) => {
+            folderFiles = files;
+            updateFileDisplay();
+        });
+        return;
+    }
+    folderFiles = null;
+    fileInput.files = e.dataTransfer.files;
+    updateFileDisplay();
+});
+
+fileInput.addEventListener('change', () => {
+    folderFiles = null;
+    folderInput.value = '';
+    updateFileDisplay();
+});
+
+folderInput.addEventListener('change', () => {
+    folderFiles = [...folderInput.files].map((file) => ({ file: file, path: file.webkitRelativePath || file.name }));
+    fileInput.value = '';
+    updateFileDisplay();
+});
+
+// readEntries hands back a directory's entries a batch at a time
+function readDirectory(dir) {
+    const reader = dir.createReader();
+    const entries = [];
+    return new Promise((resolve, reject) => {
+        const next = () => reader.readEntries((batch) => {
+            if (batch.length === 0) {
+                resolve(entries);
+                return;
+            }
+            entries.push(...batch);
+            next();
+        }, reject);
+        next();
+    });
+}
+
+async function collectFiles(entries) {
+    const files = [];
+    for (const entry of entries) {
+        if (entry.isFile) {
+            const file = await new Promise((resolve, reject) => entry.file(resolve, reject));
+            files.push({ file: file, path: entry.fullPath.replace(/^\//, '') });
+        } else if (entry.isDirectory) {
+            files.push(...await collectFiles(await readDirectory(entry)));
+        }
+    }
+    return files;
+}
+
+uploadForm.addEventListener('submit', (e) => {
+    if (!folderFiles) {
+        return;
+    }
+    e.preventDefault();
+    const body = new FormData();
+    const strip = uploadForm.querySelector('input[name="strip_metadata"]');
+    if (strip.checked) {
+        body.append('strip_metadata', '1');
+    }
+    const slug = uploadForm.querySelector('input[name="slug"]');
+    if (slug.value) {
+        body.append('slug', slug.value);
+    }
+    for (const f of folderFiles) {
+        body.append('file', f.file, f.path);
+    }
+    const button = uploadForm.querySelector('button[type="submit"]');
+    button.disabled = true;
+    fetch(uploadForm.action, {
+        method: 'POST',
+        body: body,
+        headers: { 'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content }
+    })
+    .then((response) => {
+        if (!response.ok) {
+            return response.text().then((msg) => alert(msg.trim()));
+        }
+        window.location = response.url;
+    })
+    .finally(() => {
+        button.disabled = false;
+    });
+});
+
+document.addEventListener('click', (e) => {
+    const button = e.target.closest('.copy-btn, .delete-btn');
+    if (!button) {
+        return;
+    }
+    if (button.classList.contains('copy-btn')) {
+        copyToClipboard(button, button.dataset.id, button.dataset.type);
+    } else {
+        deleteShare(button.dataset.id, button.dataset.type);
+    }
+});
+
+function updateFileDisplay() {
+    const files = folderFiles || fileInput.files;
+    const uploadBtn = document.querySelector('.upload-btn');
+    if (folderFiles) {
+        uploadBtn.textContent = folderFiles.length === 1 ? '1 file in folder' : folderFiles.length + ' files in folder';
+    } else if (files.length > 0) {
+        uploadBtn.textContent = files.length === 1 ? '1 file selected' : files.length + ' files selected';
+    } else {
+        uploadBtn.textContent = 'Choose Files';
+    }
+}
+
+function copyToClipboard(button, id, type) {
+    const url = window.location.origin + '/' + type + '/' + id;
+    navigator.clipboard.writeText(url).then(() => {
+        // Brief visual feedback
+        button.textContent = 'Copied!';
+        setTimeout(() => {
+            button.textContent = 'Copy';
+        }, 1000);
+    });
+}
+
+function deleteShare(id, type) {
+    if (!confirm('Are you sure you want to delete this share? This action cannot be undone.')) {
+        return;
+    }
+
+    const deleteUrl = '/delete/' + type + '/' + id;
+
+    fetch(deleteUrl, {
+        method: 'POST',
+        headers: {
+            'Accept': 'application/json',
+            'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content
+        }
+    })
+    .then(response => {
+        if (response.ok) {
+            // Remove the item from the DOM
+            const elementId = { c: 'clipboard-', f: 'file-', b: 'bundle-' }[type] + id;
+            const element = document.getElementById(elementId);
+            if (element) {
+                element.classList.add('removing');
+                setTimeout(() => {
+                    element.remove();
+
+                    // Check if sections are empty and show empty state
+                    updateEmptyStates();
+                }, 300);
+            }
+        } else if (response.status === 403) {
+            response.text().then((msg) => alert(msg.trim()));
+        } else {
+            alert('Failed to delete share. Please try again.');
+        }
+    })
+    .catch(error => {
+        console.error('Error deleting share:', error);
+        alert('Failed to delete share. Please try again.');
+    });
+}
+
+function updateEmptyStates() {
+    // Check clipboard section
+    const clipboardSection = document.querySelector('.link-group:first-child');
+    const clipboardItems = clipboardSection.querySelectorAll('.link-item');
+    if (clipboardItems.length === 0) {
+        clipboardSection.innerHTML = '<h3>&#128203; Text Shares</h3><div class="empty-state">No text shares yet</div>';
+    }
+
+    // Check file section
+    const fileSection = document.querySelector('.link-group:last-child');
+    const fileItems = fileSection.querySelectorAll('.link-item');
+    if (fileItems.length === 0) {
+        fileSection.innerHTML = '<h3>&#128193; File Shares</h3><div class="empty-state">No file shares yet</div>';
+    }
+}
+
+// A live scratchpad may start out empty
+const liveOption = document.querySelector('.live-option input');
+const pasteArea = document.querySelector('.clipboard-panel textarea');
+liveOption.addEventListener('change', () => {
+    pasteArea.required = !liveOption.checked;
+});
@@ -0,0 +1,263 @@
+// Live scratchpad client. Edits become ot.js-style operations (positive
+// numbers retain, negative numbers delete, strings insert) sent against the
+// last revision seen. One operation is in flight at a time; the server
+// acknowledges it through the event stream, and remote operations are
+// transformed against anything not yet acknowledged.
+
+const pad = document.getElementById('pad');
+const statusLabel = document.getElementById('padStatus');
+const presenceList = document.getElementById('presence');
+const padID = pad.dataset.id;
+const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
+const clientID = Array.from(crypto.getRandomValues(new Uint8Array(12)), (b) => b.toString(16).padStart(2, '0')).join('');
+let me = null;
+let rev = 0;
+let text = '';
+let outstanding = null;
+let buffer = [];
+
+// --- Operations ---
+
+function push(op, c) {
+    if (c === 0 || c === '') {
+        return;
+    }
+    const last = op.length - 1;
+    if (last >= 0 && typeof c === typeof op[last] && (typeof c === 'string' || Math.sign(c) === Math.sign(op[last]))) {
+        op[last] += c;
+    } else {
+        op.push(c);
+    }
+}
+
+function apply(s, op) {
+    let out = '';
+    let pos = 0;
+    for (const c of op) {
+        if (typeof c === 'string') {
+            out += c;
+        } else if (c > 0) {
+            out += s.slice(pos, pos + c);
+            pos += c;
+        } else {
+            pos -= c;
+        }
+    }
+    return out;
+}
+
+// transform(a, b) returns [a', b'] so that a then b' equals b then a'. At
+// the same position a's insertion goes first, matching the server.
+function transform(a, b) {
+    const a1 = [];
+    const b1 = [];
+    let i = 0;
+    let j = 0;
+    let ca = a[i++];
+    let cb = b[j++];
+    while (ca !== undefined || cb !== undefined) {
+        if (typeof ca === 'string') {
+            push(a1, ca);
+            push(b1, ca.length);
+            ca = a[i++];
+            continue;
+        }
+        if (typeof cb === 'string') {
+            push(a1, cb.length);
+            push(b1, cb);
+            cb = b[j++];
+            continue;
+        }
+        const m = Math.min(Math.abs(ca), Math.abs(cb));
+        if (ca > 0 && cb > 0) {
+            push(a1, m);
+            push(b1, m);
+        } else if (ca < 0 && cb > 0) {
+            push(a1, -m);
+        } else if (ca > 0 && cb < 0) {
+            push(b1, -m);
+        }
+        ca = ca > 0 ? ca - m : ca + m;
+        cb = cb > 0 ? cb - m : cb + m;
+        if (ca === 0) {
+            ca = a[i++];
+        }
+        if (cb === 0) {
+            cb = b[j++];
+        }
+    }
+    return [a1, b1];
+}
+
+function transformIndex(pos, op) {
+    let newPos = pos;
+    let i = 0;
+    for (const c of op) {
+        if (i > pos) {
+            break;
+        }
+        if (typeof c === 'string') {
+            newPos += c.length;
+        } else if (c > 0) {
+            i += c;
+        } else {
+            newPos -= Math.min(pos - i, -c);
+            i -= c;
+        }
+    }
+    return newPos;
+}
+
+// diff turns one edit of the textarea into an operation, without
+// splitting surrogate pairs.
+function diff(before, after) {
+    let prefix = 0;
+    const max = Math.min(before.length, after.length);
+    while (prefix < max && before[prefix] === after[prefix]) {
+        prefix++;
+    }
+    if (prefix > 0 && /[\uD800-\uDBFF]/.test(before[prefix - 1])) {
+        prefix--;
+    }
+    let suffix = 0;
+    while (suffix < max - prefix && before[before.length - 1 - suffix] === after[after.length - 1 - suffix]) {
+        suffix++;
+    }
+    if (suffix > 0 && /[\uDC00-\uDFFF]/.test(after[after.length - suffix])) {
+        suffix--;
+    }
+    const op = [];
+    push(op, prefix);
+    push(op, -(before.length - prefix - suffix));
+    push(op, after.slice(prefix, after.length - suffix));
+    push(op, suffix);
+    return op;
+}
+
+// --- Server ---
+
+function post(message) {
+    message.client = clientID;
+    return fetch('/c/' + padID + '/ops', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+        body: JSON.stringify(message),
+    }).then((res) => {
+        if (res.status === 409 || res.status === 400) {
+            // Our view of the document can't be reconciled; start over
+            window.location.reload();
+        } else if (!res.ok) {
+            res.text().then((msg) => setStatus(msg.trim(), false));
+        }
+    });
+}
+
+function send(op) {
+    outstanding = op;
+    post({ rev: rev, op: op, cursor: pad.selectionStart });
+}
+
+function setStatus(message, connected) {
+    statusLabel.textContent = message;
+    statusLabel.classList.toggle('connected', connected);
+}
+
+pad.addEventListener('input', () => {
+    const op = diff(text, pad.value);
+    text = pad.value;
+    if (op.every((c) => typeof c === 'number' && c > 0)) {
+        return;
+    }
+    if (outstanding === null) {
+        send(op);
+    } else {
+        buffer.push(op);
+    }
+});
+
+// Share where the cursor is, at most a few times a second
+let cursorTimer = null;
+function cursorMoved() {
+    if (cursorTimer !== null || me === null) {
+        return;
+    }
+    cursorTimer = setTimeout(() => {
+        cursorTimer = null;
+        if (outstanding === null) {
+            post({ rev: rev, cursor: pad.selectionStart });
+        }
+    }, 300);
+}
+pad.addEventListener('keyup', cursorMoved);
+pad.addEventListener('click', cursorMoved);
+
+function applyRemote(op) {
+    const start = transformIndex(pad.selectionStart, op);
+    const end = transformIndex(pad.selectionEnd, op);
+    const scroll = pad.scrollTop;
+    pad.value = apply(pad.value, op);
+    pad.setSelectionRange(start, end);
+    pad.scrollTop = scroll;
+    text = pad.value;
+}
+
+function renderPresence(clients) {
+    presenceList.replaceChildren(...clients.map((c) => {
+        const item = document.createElement('li');
+        item.style.setProperty('--color', c.color);
+        item.textContent = c.name + ' · line ' + c.line;
+        if (me && c.id === me.id) {
+            item.classList.add('you');
+            item.textContent += ' (you)';
+        }
+        return item;
+    }));
+}
+
+const events = new EventSource('/c/' + padID + '/events?client=' + clientID);
+
+events.addEventListener('snapshot', (e) => {
+    const snapshot = JSON.parse(e.data);
+    me = snapshot.you;
+    rev = snapshot.rev;
+    outstanding = null;
+    buffer = [];
+    pad.value = snapshot.text;
+    text = snapshot.text;
+    pad.disabled = false;
+    setStatus('Connected as ' + me.name, true);
+});
+
+events.addEventListener('op', (e) => {
+    const msg = JSON.parse(e.data);
+    rev = msg.rev;
+    if (msg.client === clientID) {
+        // Our own operation, acknowledged
+        outstanding = null;
+        if (buffer.length > 0) {
+            send(buffer.shift());
+        }
+        return;
+    }
+    let op = msg.op;
+    if (outstanding !== null) {
+        [outstanding, op] = transform(outstanding, op);
+    }
+    for (let k = 0; k < buffer.length; k++) {
+        [buffer[k], op] = transform(buffer[k], op);
+    }
+    applyRemote(op);
+});
+
+events.addEventListener('presence', (e) => renderPresence(JSON.parse(e.data)));
+
+events.addEventListener('closed', () => {
+    events.close();
+    window.location.reload();
+});
+
+events.addEventListener('error', () => {
+    pad.disabled = true;
+    setStatus('Reconnecting…', false);
+});
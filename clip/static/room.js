@@ -0,0 +1,126 @@
+// Live room: new shares from any device appear at the top without a
+// reload, and the forms send without leaving the page.
+
+const list = document.getElementById('roomItems');
+const empty = document.getElementById('roomEmpty');
+const statusLabel = document.getElementById('roomStatus');
+const roomID = list.dataset.id;
+const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
+function renderItem(item) {
+    const li = document.createElement('li');
+    li.dataset.key = item.type + '/' + item.id;
+    const meta = document.createElement('div');
+    meta.className = 'room-meta';
+    const label = document.createElement('span');
+    const link = document.createElement('a');
+    const time = new Date(item.created_at).toTimeString().slice(0, 5);
+
+    if (item.type === 'text') {
+        const preview = document.createElement('pre');
+        preview.className = 'room-preview';
+        preview.textContent = item.preview;
+        li.append(preview);
+        link.href = '/c/' + item.id;
+        link.textContent = item.id;
+        label.append('📋 ', link, ' · ' + item.size_label + ' · ' + time);
+        const copy = document.createElement('button');
+        copy.className = 'copy-text';
+        copy.dataset.raw = '/c/' + item.id + '/raw';
+        copy.textContent = 'Copy';
+        meta.append(label, copy);
+    } else if (item.type === 'bundle') {
+        link.href = '/b/' + item.id;
+        link.textContent = item.filename;
+        label.append('🗂️ ', link, ' · ' + item.size_label + ' · ' + time);
+        const download = document.createElement('a');
+        download.href = '/b/' + item.id + '/zip';
+        download.className = 'download';
+        download.textContent = 'Download all';
+        meta.append(label, download);
+    } else {
+        link.href = '/f/' + item.id;
+        link.textContent = item.filename;
+        label.append('📁 ', link, ' · ' + item.size_label + ' · ' + time);
+        const download = document.createElement('a');
+        download.href = '/f/' + item.id;
+        download.className = 'download';
+        download.textContent = 'Download';
+        meta.append(label, download);
+    }
+    li.append(meta);
+    return li;
+}
+
+function updateEmpty() {
+    empty.hidden = list.children.length > 0;
+}
+
+list.addEventListener('click', (e) => {
+    const button = e.target.closest('.copy-text');
+    if (!button) {
+        return;
+    }
+    fetch(button.dataset.raw).then((res) => res.text()).then((text) => navigator.clipboard.writeText(text)).then(() => {
+        button.textContent = 'Copied!';
+        setTimeout(() => {
+            button.textContent = 'Copy';
+        }, 1000);
+    });
+});
+
+// Send without reloading; the new item arrives through the event stream
+for (const form of document.querySelectorAll('.room-form')) {
+    form.addEventListener('submit', (e) => {
+        e.preventDefault();
+        const body = form.enctype === 'multipart/form-data' ? new FormData(form) : new URLSearchParams(new FormData(form));
+        const button = form.querySelector('button');
+        button.disabled = true;
+        fetch(form.action, { method: 'POST', body: body, headers: { 'X-CSRF-Token': csrfToken } })
+            .then((res) => {
+                if (!res.ok) {
+                    return res.text().then((msg) => alert(msg.trim()));
+                }
+                form.reset();
+            })
+            .finally(() => {
+                button.disabled = false;
+            });
+    });
+}
+
+const events = new EventSource('/r/' + roomID + '/events');
+
+events.addEventListener('snapshot', (e) => {
+    const items = JSON.parse(e.data);
+    list.replaceChildren(...items.reverse().map(renderItem));
+    updateEmpty();
+    statusLabel.textContent = 'Live';
+    statusLabel.classList.add('connected');
+});
+
+events.addEventListener('item', (e) => {
+    const li = renderItem(JSON.parse(e.data));
+    li.classList.add('new');
+    list.prepend(li);
+    updateEmpty();
+});
+
+events.addEventListener('removed', (e) => {
+    const item = JSON.parse(e.data);
+    const li = list.querySelector('[data-key="' + CSS.escape(item.type + '/' + item.id) + '"]');
+    if (li) {
+        li.remove();
+    }
+    updateEmpty();
+});
+
+events.addEventListener('closed', () => {
+    events.close();
+    window.location.reload();
+});
+
+events.addEventListener('error', () => {
+    statusLabel.textContent = 'Reconnecting…';
+    statusLabel.classList.remove('connected');
+});
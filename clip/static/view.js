@@ -0,0 +1,80 @@
+const copyButton = document.getElementById('copyContent');
+copyButton.addEventListener('click', () => {
+    // Copy the original text, which rendered Markdown no longer shows
+    fetch(copyButton.dataset.raw).then((res) => res.text()).then((text) => navigator.clipboard.writeText(text)).then(() => {
+        copyButton.textContent = 'Copied!';
+        setTimeout(() => {
+            copyButton.textContent = 'Copy Content';
+        }, 1000);
+    });
+});
+
+// The rest only applies to the source view; rendered Markdown has no lines
+const code = document.querySelector('.code');
+if (code) {
+    setupSourceView();
+}
+
+function setupSourceView() {
+    // Line wrapping, remembered across shares
+    const wrapLines = document.getElementById('wrapLines');
+    wrapLines.checked = localStorage.getItem('clip-wrap') === '1';
+    code.classList.toggle('wrap', wrapLines.checked);
+    wrapLines.addEventListener('change', () => {
+        code.classList.toggle('wrap', wrapLines.checked);
+        localStorage.setItem('clip-wrap', wrapLines.checked ? '1' : '0');
+    });
+
+    // Linkable lines and ranges: #L10 or #L10-L20. Shift-click a line number
+    // to extend the selection.
+    let anchorLine = null;
+
+    function selectLines(from, to) {
+        if (from > to) {
+            [from, to] = [to, from];
+        }
+        document.querySelectorAll('.code tr.selected').forEach((row) => row.classList.remove('selected'));
+        for (let n = from; n <= to; n++) {
+            const row = document.getElementById('L' + n);
+            if (row) {
+                row.classList.add('selected');
+            }
+        }
+        return [from, to];
+    }
+
+    function applyHash(scroll) {
+        const match = /^#L(\d+)(?:-L(\d+))?$/.exec(window.location.hash);
+        if (!match) {
+            return;
+        }
+        const from = parseInt(match[1], 10);
+        const [first] = selectLines(from, match[2] ? parseInt(match[2], 10) : from);
+        anchorLine = from;
+        const row = document.getElementById('L' + first);
+        if (scroll && row) {
+            row.scrollIntoView({ block: 'center' });
+        }
+    }
+
+    code.addEventListener('click', (e) => {
+        const link = e.target.closest('.ln a');
+        if (!link) {
+            return;
+        }
+        e.preventDefault();
+        const line = parseInt(link.dataset.line, 10);
+        let hash = '#L' + line;
+        if (e.shiftKey && anchorLine !== null && anchorLine !== line) {
+            const [from, to] = selectLines(anchorLine, line);
+            hash = '#L' + from + '-L' + to;
+        } else {
+            selectLines(line, line);
+            anchorLine = line;
+        }
+        history.replaceState(null, '', hash);
+    });
+
+    window.addEventListener('hashchange', () => applyHash(true));
+    applyHash(true);
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Per-file upload limit.
+const maxUploadSize = 1 << 30 // 1GB
+
+// How often (in bytes written) a streaming upload re-checks free disk space.
+const diskCheckInterval = 16 << 20
+
+var (
+	// maxStorageBytes caps the total size of uploads/ (0 means unlimited).
+	maxStorageBytes int64
+	// minFreeBytes is the free space that must remain on the volume.
+	minFreeBytes int64 = 512 << 20
+
+	// storageUsed tracks the bytes currently held in uploads/.
+	storageUsed atomic.Int64
+)
+
+var errStorageFull = errors.New("storage is nearly full")
+
+// byteSize is a flag.Value accepting sizes such as "512M" or "10G".
+type byteSize struct{ n *int64 }
+
+func (b byteSize) String() string {
+	if b.n == nil {
+		return "0"
+	}
+	return formatBytes(*b.n)
+}
+
+func (b byteSize) Set(s string) error {
+	n, err := parseBytes(s)
+	if err != nil {
+		return err
+	}
+	*b.n = n
+	return nil
+}
+
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+	shift := 0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// initStorageUsage seeds storageUsed from whatever is already on disk.
+func initStorageUsage() error {
+	var total int64
+	err := filepath.WalkDir("uploads", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	storageUsed.Store(total)
+	return err
+}
+
+// checkCapacity reports errStorageFull if storing n more bytes would exceed
+// the configured total or leave less than minFreeBytes on the volume.
+func checkCapacity(n int64) error {
+	if maxStorageBytes > 0 && storageUsed.Load()+n > maxStorageBytes {
+		return errStorageFull
+	}
+	if free, ok := diskFree("uploads"); ok && free-n < minFreeBytes {
+		return errStorageFull
+	}
+	return nil
+}
+
+// storageLow reports whether the store is close to its limits. It is only a
+// warning for operators, the low_space status in /healthz and the notice on
+// /admin; nothing is cleaned up or refused because of it.
+func storageLow() bool {
+	if maxStorageBytes > 0 && storageUsed.Load() > maxStorageBytes/10*9 {
+		return true
+	}
+	free, ok := diskFree("uploads")
+	return ok && free < minFreeBytes*2
+}
+
+// removeUpload deletes a stored file and releases its bytes.
+func removeUpload(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	storageUsed.Add(-info.Size())
+	return nil
+}
+
+// writeUpload writes data to path, accounting for it in storageUsed.
+func writeUpload(path string, data []byte) error {
+	if err := checkCapacity(int64(len(data))); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	storageUsed.Add(int64(len(data)))
+	return nil
+}
+
+// replaceUpload overwrites path with data, accounting only for the change
+// in size.
+func replaceUpload(path string, data []byte) error {
+	var old int64
+	if info, err := os.Stat(path); err == nil {
+		old = info.Size()
+	}
+	if grow := int64(len(data)) - old; grow > 0 {
+		if err := checkCapacity(grow); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	storageUsed.Add(int64(len(data)) - old)
+	return nil
+}
+
+// quotaWriter counts bytes towards storageUsed as they are written and
+// fails with errStorageFull once the store runs out of room.
+type quotaWriter struct {
+	w         io.Writer
+	written   int64
+	nextCheck int64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if maxStorageBytes > 0 && storageUsed.Load()+n > maxStorageBytes {
+		return 0, errStorageFull
+	}
+	if q.written+n >= q.nextCheck {
+		if free, ok := diskFree("uploads"); ok && free-n < minFreeBytes {
+			return 0, errStorageFull
+		}
+		q.nextCheck = q.written + n + diskCheckInterval
+	}
+	written, err := q.w.Write(p)
+	q.written += int64(written)
+	storageUsed.Add(int64(written))
+	return written, err
+}
+
+// storageStatus is the storage section of the health report.
+type storageStatus struct {
+	UsedBytes    int64 `json:"used_bytes"`
+	MaxBytes     int64 `json:"max_bytes,omitempty"`
+	FreeBytes    int64 `json:"free_bytes,omitempty"`
+	MinFreeBytes int64 `json:"min_free_bytes"`
+	Low          bool  `json:"low"`
+}
+
+func currentStorageStatus() storageStatus {
+	s := storageStatus{
+		UsedBytes:    storageUsed.Load(),
+		MaxBytes:     maxStorageBytes,
+		MinFreeBytes: minFreeBytes,
+		Low:          storageLow(),
+	}
+	if free, ok := diskFree("uploads"); ok {
+		s.FreeBytes = free
+	}
+	return s
+}